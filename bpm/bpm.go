@@ -4,11 +4,18 @@
 package bpm
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
 	"math"
 	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
@@ -20,32 +27,122 @@ const (
 	Y        = 512
 )
 
+// Config holds the tunable parameters of the BPM detection.
+type Config struct {
+	// Overlap is the overlap factor between consecutive envelope windows, in
+	// [0, 1). With an overlap, the envelope is sampled every
+	// Interval * (1 - Overlap) input samples instead of every Interval samples,
+	// which better captures sharp transients at the cost of a larger envelope.
+	// BPM to envelope interval conversions use this hop size, so results stay
+	// expressed in the same unit.
+	Overlap float64
+
+	// Rate is the sample rate of the signal, in Hz. Zero means Rate.
+	Rate int
+}
+
+// Default is the configuration used by Scan.
+var Default Config
+
 // Scan returns the BPM of audio data from a Reader containing f32le samples.
 // The BPM detection is between the given range.
 func Scan(r io.Reader, min, max float64) (float64, error) {
-	nrg, err := energy(r)
+	return Default.Scan(r, min, max)
+}
+
+// ScanWithSeed is like Scan but the random sampling of the signal is seeded
+// with the given value, which makes the result reproducible.
+func ScanWithSeed(r io.Reader, min, max float64, seed int64) (float64, error) {
+	return Default.ScanWithSeed(r, min, max, seed)
+}
+
+// ScanContext is like Scan but stops the interval sweep early and returns the
+// error of the context when it is done.
+func ScanContext(ctx context.Context, r io.Reader, min, max float64) (float64, error) {
+	return Default.ScanContext(ctx, r, min, max)
+}
+
+// Scan returns the BPM of audio data from a Reader containing f32le samples
+// using the given configuration.
+func (c Config) Scan(r io.Reader, min, max float64) (float64, error) {
+	return c.ScanContext(context.Background(), r, min, max)
+}
+
+// ScanWithSeed is like Config.Scan with a seeded random sampling.
+func (c Config) ScanWithSeed(r io.Reader, min, max float64, seed int64) (float64, error) {
+	return c.scan(context.Background(), r, min, max, seed)
+}
+
+// ScanContext is like Config.Scan with a context, as in ScanContext.
+func (c Config) ScanContext(ctx context.Context, r io.Reader, min, max float64) (float64, error) {
+	return c.scan(ctx, r, min, max, time.Now().UnixNano())
+}
+
+func (c Config) scan(ctx context.Context, r io.Reader, min, max float64, seed int64) (float64, error) {
+	if c.Overlap < 0 || c.Overlap >= 1 {
+		return 0, errors.New("overlap must be in [0, 1)")
+	}
+
+	if c.Rate < 0 {
+		return 0, errors.New("sample rate must be positive")
+	}
+
+	nrg, err := c.Energy(r)
 	if err != nil {
 		return 0, err
 	}
-	return scan(nrg, min, max), nil
+
+	//nolint:gosec
+	rng := rand.New(rand.NewSource(seed))
+
+	return scan(ctx, nrg, min, max, float64(c.hop()), c.rate(), rng)
 }
 
-func energy(r io.Reader) ([]float32, error) {
-	res := make([]float32, 0)
+// Energy returns the envelope of audio data from a Reader containing f32le
+// samples, as used for the detection. It holds one value every Interval input
+// samples, so its sample rate is Rate / Interval (about 344Hz).
+func Energy(r io.Reader) ([]float32, error) {
+	return Default.Energy(r)
+}
 
-	var v, n float64
+// Energy is like Energy using the given configuration. The envelope holds one
+// value every Interval * (1 - Overlap) input samples.
+func (c Config) Energy(r io.Reader) ([]float32, error) {
+	return energy(r, c.hop())
+}
 
-	for {
-		var f float32
+// rate returns the sample rate of the signal.
+func (c Config) rate() float64 {
+	if c.Rate == 0 {
+		return Rate
+	}
+	return float64(c.Rate)
+}
 
-		switch err := binary.Read(r, binary.LittleEndian, &f); {
+// hop returns the number of input samples between two envelope samples.
+func (c Config) hop() int {
+	return max(1, int(math.Round(Interval*(1-c.Overlap))))
+}
+
+// energy computes the envelope of the signal, reading it incrementally so the
+// raw samples are never held in memory.
+func energy(r io.Reader, hop int) ([]float32, error) {
+	res := make([]float32, 0, capacity(r, hop))
+	br := bufio.NewReaderSize(r, 1<<16)
+
+	var b [4]byte
+	var v float64
+	var n int
+
+	for {
+		switch _, err := io.ReadFull(br, b[:]); {
 		case errors.Is(err, io.EOF):
 			return res, nil
 		case err != nil:
 			return nil, err
 		}
 
-		z := math.Abs(float64(f))
+		z := math.Abs(float64(math.Float32frombits(binary.LittleEndian.Uint32(b[:]))))
 		if z > v {
 			v += (z - v) / X
 		} else {
@@ -53,33 +150,110 @@ func energy(r io.Reader) ([]float32, error) {
 		}
 
 		n++
-		if n == Interval {
+		if n == hop {
 			n, res = 0, append(res, float32(v))
 		}
 	}
 }
 
-func scan(nrg []float32, min, max float64) float64 {
-	imin := bpmToInterval(min)
-	imax := bpmToInterval(max)
+// capacity returns the size of the envelope of the signal if its length is
+// known beforehand, or zero.
+func capacity(r io.Reader, hop int) int {
+	switch impl := r.(type) {
+	case interface{ Len() int }:
+		return impl.Len() / 4 / hop
+	case *os.File:
+		if info, err := impl.Stat(); err == nil && info.Mode().IsRegular() {
+			return int(info.Size()) / 4 / hop
+		}
+	}
+	return 0
+}
+
+// chunks is the number of parts of the interval sweep run concurrently. It is
+// fixed so the result of a seeded scan doesn't depend on the number of CPUs.
+const chunks = 16
+
+// trough is the interval with the lowest autodifference over a sweep.
+type trough struct {
+	interval, height float64
+}
+
+func scan(ctx context.Context, nrg []float32, min, max, hop, rate float64, rng *rand.Rand) (float64, error) {
+	imin := bpmToInterval(min, hop, rate)
+	imax := bpmToInterval(max, hop, rate)
 	step := (imin - imax) / float64(Steps)
 
-	height, trough := math.Inf(0), math.NaN()
+	// Each chunk gets its own source to avoid contention on a shared one.
+	seeds := make([]int64, chunks)
+	for c := range seeds {
+		seeds[c] = rng.Int63()
+	}
+
+	res, jobs, wg := make([]trough, chunks), make(chan int), new(sync.WaitGroup)
+
+	for w := 0; w < workers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				res[c] = sweep(ctx, nrg, imax, step, c, rand.New(rand.NewSource(seeds[c])))
+			}
+		}()
+	}
+
+	for c := 0; c < chunks; c++ {
+		jobs <- c
+	}
+
+	close(jobs)
+
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// Ties are won by the lowest interval, as in a sequential sweep.
+	best := trough{math.NaN(), math.Inf(0)}
+	for _, t := range res {
+		if t.height < best.height {
+			best = t
+		}
+	}
+
+	return intervalToBpm(best.interval, hop, rate), nil
+}
+
+// sweep computes the trough of the c-th chunk of the Steps + 1 intervals
+// starting at imax. It stops early if the context is done.
+func sweep(ctx context.Context, nrg []float32, imax, step float64, c int, rng *rand.Rand) trough {
+	size := (Steps + chunks) / chunks
+	res := trough{math.NaN(), math.Inf(0)}
+
+	for i := c * size; i < (c+1)*size && i <= Steps; i++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		interval := imax + float64(i)*step
 
-	for interval := imax; interval <= imin; interval += step {
 		var t float64
 
 		for s := 0; s < Samples; s++ {
-			t += autodifference(nrg, interval)
+			t += autodifference(nrg, interval, rng)
 		}
 
-		if t < height {
-			trough = interval
-			height = t
+		if t < res.height {
+			res = trough{interval, t}
 		}
 	}
 
-	return intervalToBpm(trough)
+	return res
+}
+
+func workers() int {
+	return max(1, min(runtime.NumCPU(), chunks))
 }
 
 var (
@@ -87,9 +261,8 @@ var (
 	nobeats = [...]float64{-0.5, -0.25, 0.25, 0.5}
 )
 
-func autodifference(nrg []float32, interval float64) float64 {
-	//nolint:gosec
-	mid := rand.Float64() * float64(len(nrg))
+func autodifference(nrg []float32, interval float64, rng *rand.Rand) float64 {
+	mid := rng.Float64() * float64(len(nrg))
 
 	v := sample(nrg, mid)
 
@@ -120,14 +293,136 @@ func sample(nrg []float32, offset float64) float64 {
 	return 0.0
 }
 
-func bpmToInterval(bpm float64) float64 {
+// Onset detection parameters: the threshold is Sensitivity times the mean
+// rise of the envelope over a window of Window seconds around each sample.
+const (
+	Sensitivity = 1.5
+	Window      = 0.5
+)
+
+// OnsetScan returns the BPM of audio data from a Reader containing f32le
+// samples. Unlike Scan, it detects the onsets (sharp rises of the envelope)
+// and derives the tempo from the median interval between them, which suits
+// sparse percussion better. The result is folded into the given range.
+func OnsetScan(r io.Reader, min, max float64) (float64, error) {
+	return Default.OnsetScan(r, min, max)
+}
+
+// OnsetScan is like OnsetScan using the given configuration.
+func (c Config) OnsetScan(r io.Reader, min, max float64) (float64, error) {
+	if c.Overlap < 0 || c.Overlap >= 1 {
+		return 0, errors.New("overlap must be in [0, 1)")
+	}
+
+	if c.Rate < 0 {
+		return 0, errors.New("sample rate must be positive")
+	}
+
+	nrg, err := c.Energy(r)
+	if err != nil {
+		return 0, err
+	}
+
+	hop, rate := float64(c.hop()), c.rate()
+
+	// Onsets closer than a beat at twice the maximum tempo are ignored.
+	spacing := bpmToInterval(2*max, hop, rate)
+
+	found := onsets(nrg, spacing, Window*rate/hop)
+	if len(found) < 2 {
+		return 0, errors.New("not enough onsets")
+	}
+
+	intervals := make([]float64, len(found)-1)
+	for i := range intervals {
+		intervals[i] = found[i+1] - found[i]
+	}
+
+	return clamp(intervalToBpm(median(intervals), hop, rate), min, max), nil
+}
+
+// onsets returns the positions of the onsets of an envelope, in envelope
+// samples. An onset is a local maximum of the rise of the envelope above an
+// adaptive threshold, at least spacing samples after the previous one (or the
+// beginning of the envelope).
+func onsets(nrg []float32, spacing, window float64) []float64 {
+	rise := make([]float64, len(nrg))
+	for i := 1; i < len(nrg); i++ {
+		rise[i] = max(0, float64(nrg[i]-nrg[i-1]))
+	}
+
+	// Prefix sums give the mean rise over any window in constant time.
+	sums := make([]float64, len(rise)+1)
+	for i, v := range rise {
+		sums[i+1] = sums[i] + v
+	}
+
+	half := max(1, int(window/2))
+	res := make([]float64, 0)
+
+	// The envelope rises from zero at the beginning, which is not an onset.
+	last := 0.0
+
+	for i := 1; i < len(rise)-1; i++ {
+		if rise[i] <= rise[i-1] || rise[i] < rise[i+1] {
+			continue
+		}
+
+		lo, hi := max(0, i-half), min(len(rise), i+half+1)
+		if rise[i] <= Sensitivity*(sums[hi]-sums[lo])/float64(hi-lo) {
+			continue
+		}
+
+		// Refine the position with a parabolic interpolation of the peak.
+		pos := float64(i)
+		if d := rise[i-1] - 2*rise[i] + rise[i+1]; d != 0 {
+			pos += 0.5 * (rise[i-1] - rise[i+1]) / d
+		}
+
+		if pos-last < spacing {
+			continue
+		}
+
+		res, last = append(res, pos), pos
+	}
+
+	return res
+}
+
+// median returns the median of values.
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	return sorted[n/2]
+}
+
+// clamp folds a BPM into a range by factors of two, then bounds it.
+func clamp(bpm, min, max float64) float64 {
+	for bpm < min && bpm*2 <= max {
+		bpm *= 2
+	}
+	for bpm > max && bpm/2 >= min {
+		bpm /= 2
+	}
+	return math.Max(min, math.Min(max, bpm))
+}
+
+// Intervals are expressed in envelope samples, each one spanning hop input
+// samples at the given sample rate.
+func bpmToInterval(bpm, hop, rate float64) float64 {
 	beatsPerSecond := bpm / 60
-	samplesPerBeat := Rate / beatsPerSecond
-	return samplesPerBeat / Interval
+	samplesPerBeat := rate / beatsPerSecond
+	return samplesPerBeat / hop
 }
 
-func intervalToBpm(interval float64) float64 {
-	samplesPerBeat := interval * Interval
-	beatsPerSecond := Rate / samplesPerBeat
+func intervalToBpm(interval, hop, rate float64) float64 {
+	samplesPerBeat := interval * hop
+	beatsPerSecond := rate / samplesPerBeat
 	return beatsPerSecond * 60
 }
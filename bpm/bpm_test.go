@@ -1,7 +1,12 @@
 package bpm_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"mkcdj/bpm"
 	"os"
 	"testing"
@@ -14,7 +19,7 @@ func TestBPM(t *testing.T) {
 	}
 	defer fd.Close()
 
-	got, err := bpm.Scan(fd, 115, 128)
+	got, err := bpm.ScanWithSeed(fd, 115, 128, 3)
 	if err != nil {
 		t.Error(err)
 	}
@@ -22,6 +27,151 @@ func TestBPM(t *testing.T) {
 	assert(t, "118", fmt.Sprintf("%.0f", got))
 }
 
+func TestSeed(t *testing.T) {
+	data, err := os.ReadFile("./testdata/track.dat")
+	if err != nil {
+		t.Error(err)
+	}
+
+	a, err := bpm.ScanWithSeed(bytes.NewReader(data), 115, 128, 42)
+	if err != nil {
+		t.Error(err)
+	}
+
+	b, err := bpm.ScanWithSeed(bytes.NewReader(data), 115, 128, 42)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert(t, fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func TestScanContext(t *testing.T) {
+	data, err := os.ReadFile("./testdata/track.dat")
+	if err != nil {
+		t.Error(err)
+	}
+
+	got, err := bpm.ScanContext(context.Background(), bytes.NewReader(data), 115, 128)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if math.Abs(got-118) > 3 {
+		t.Errorf("want: 118±3, got: %.2f", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := bpm.ScanContext(ctx, bytes.NewReader(data), 115, 128); !errors.Is(err, context.Canceled) {
+		t.Errorf("want: %v, got: %v", context.Canceled, err)
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	fd, err := os.Open("./testdata/track.dat")
+	if err != nil {
+		t.Error(err)
+	}
+	defer fd.Close()
+
+	got, err := bpm.Config{Overlap: 0.5}.Scan(fd, 115, 128)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if math.Abs(got-118) > 3 {
+		t.Errorf("want: 118±3, got: %.2f", got)
+	}
+
+	if _, err := (bpm.Config{Overlap: 1}).Scan(fd, 115, 128); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
+
+func TestOnsetScan(t *testing.T) {
+	data, err := os.ReadFile("./testdata/track.dat")
+	if err != nil {
+		t.Error(err)
+	}
+
+	onset, err := bpm.OnsetScan(bytes.NewReader(data), 115, 128)
+	if err != nil {
+		t.Error(err)
+	}
+
+	scan, err := bpm.ScanWithSeed(bytes.NewReader(data), 115, 128, 3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Logf("onset: %.2f, scan: %.2f", onset, scan)
+
+	// The fixture only holds four beats and an envelope sample is worth about
+	// 1.5 BPM at this tempo: both methods must agree within 5%.
+	if math.Abs(onset-scan) > scan*0.05 {
+		t.Errorf("want: %.2f±5%%, got: %.2f", scan, onset)
+	}
+
+	got, err := bpm.OnsetScan(clicks(bpm.Rate, 124, 10), 100, 140)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if math.Abs(got-124) > 1 {
+		t.Errorf("want: 124±1, got: %.2f", got)
+	}
+
+	if _, err := bpm.OnsetScan(bytes.NewReader(make([]byte, 4*bpm.Rate)), 100, 140); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
+
+func TestEnergy(t *testing.T) {
+	fd, err := os.Open("./testdata/track.dat")
+	if err != nil {
+		t.Error(err)
+	}
+	defer fd.Close()
+
+	nrg, err := bpm.Energy(fd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The fixture holds one second of audio.
+	assert(t, fmt.Sprint(bpm.Rate/bpm.Interval), fmt.Sprint(len(nrg)))
+}
+
+func TestRate(t *testing.T) {
+	for _, rate := range []int{44100, 48000} {
+		got, err := bpm.Config{Rate: rate}.ScanWithSeed(clicks(rate, 124, 10), 100, 140, 3)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if math.Abs(got-124) > 1 {
+			t.Errorf("want: 124±1 at %dHz, got: %.2f", rate, got)
+		}
+	}
+}
+
+// clicks returns f32le samples of a click track at the given tempo.
+func clicks(rate int, tempo float64, seconds int) *bytes.Buffer {
+	out := make([]float32, rate*seconds)
+	period := int(float64(rate) * 60 / tempo)
+	for i := 0; i < len(out); i += period {
+		for j := i; j < min(i+rate/100, len(out)); j++ {
+			out[j] = float32(math.Sin(2 * math.Pi * 1000 * float64(j-i) / float64(rate)))
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, out) //nolint:errcheck
+	return buf
+}
+
 func assert(t *testing.T, want, got string) {
 	if want != got {
 		t.Errorf("want: %s, got: %s", want, got)
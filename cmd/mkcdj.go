@@ -1,106 +1,946 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"mkcdj"
 	"mkcdj/bpm"
+	"mkcdj/doctor"
 	"mkcdj/ffmpeg"
+	"mkcdj/key"
+	"mkcdj/quality"
+	"mkcdj/selftest"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 )
 
-var verbose = flag.Bool("v", false, "Print additional information")
+var (
+	verbose   = flag.Bool("v", false, "Print additional information")
+	storePath = flag.String("store", "", "Path of the repository, overrides MKCDJ_STORE")
+)
 
 func main() {
 	flag.Parse()
 
-	if err := run(flag.Args()...); err != nil {
+	cfg, err := loadConfig()
+	if err == nil {
+		err = run(os.Stdout, cfg, flag.Args()...)
+	}
+
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
 		os.Exit(1)
 	}
 }
 
-func run(args ...string) error {
-	if *verbose {
-		log.SetOutput(os.Stderr)
-	} else {
-		log.SetOutput(io.Discard)
+// run executes a command with the given configuration, writing its results to
+// out.
+func run(out io.Writer, cfg Config, args ...string) error {
+	all, err := buildOptions(cfg)
+	if err != nil {
+		return err
 	}
+	opts := options{repo: all[0], all: all}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
+	if len(args) > 0 && cfg.Store == "-" && !readOnly[args[0]] {
+		return fmt.Errorf("%s: the repository read from the standard input is read-only", args[0])
+	}
+
+	if len(args) > 0 && external[args[0]] {
+		if err := ffmpeg.Check(); err != nil {
+			return err
+		}
+	}
+
 	switch {
 	case len(args) < 1:
 		return errUsage
-	case args[0] == "analyze" && len(args) == 3:
-		return analyze(ctx, args[1], args[2])
-	case args[0] == "compile" && len(args) == 2:
-		return compile(ctx, args[1])
-	case args[0] == "refresh" && len(args) == 1:
-		return refresh(ctx)
-	case args[0] == "list" && len(args) == 1:
-		return list(os.Stdout)
-	case args[0] == "files" && len(args) == 1:
-		return files(os.Stdout)
-	case args[0] == "prune" && len(args) == 1:
-		return prune()
+	case args[0] == "analyze":
+		return analyze(ctx, opts, args[1:]...)
+	case args[0] == "analyze-dir" && len(args) == 3:
+		return analyzeDir(ctx, opts, args[1], args[2])
+	case args[0] == "compile":
+		return compile(ctx, opts, out, args[1:]...)
+	case args[0] == "export-csv" && len(args) == 1:
+		return mkcdj.New(opts.repo).ExportCSV(out)
+	case args[0] == "import-csv" && len(args) == 2:
+		return importCSV(opts, args[1])
+	case args[0] == "export" && len(args) == 2:
+		return export(opts, args[1])
+	case args[0] == "refresh":
+		return refresh(ctx, opts, args[1:]...)
+	case args[0] == "requality" && len(args) == 1:
+		return requality(ctx, opts)
+	case args[0] == "list":
+		return list(opts, out, args[1:]...)
+	case args[0] == "search":
+		return search(opts, out, args[1:]...)
+	case args[0] == "extract":
+		return extract(opts, out, args[1:]...)
+	case args[0] == "find":
+		return find(opts, out, args[1:]...)
+	case args[0] == "stats" && len(args) == 1:
+		return stats(opts, out)
+	case args[0] == "duplicates" && len(args) == 1:
+		return mkcdj.New(opts.repo).Duplicates(out)
+	case args[0] == "files":
+		return files(opts, out, args[1:]...)
+	case args[0] == "verify" && len(args) == 1:
+		return mkcdj.New(opts.repo).Verify(out)
+	case args[0] == "names" && len(args) == 1:
+		return mkcdj.New(opts.all...).Names(out)
+	case args[0] == "prune":
+		return prune(opts, out, args[1:]...)
+	case args[0] == "rebase" && len(args) == 3:
+		return rebase(opts, out, args[1], args[2])
+	case args[0] == "set-preset":
+		return setPreset(opts, args[1:]...)
+	case args[0] == "set-format" && len(args) == 3:
+		return setFormat(opts, args[1], args[2])
+	case args[0] == "presets":
+		return presetsCmd(opts, out, args[1:]...)
+	case args[0] == "eval" && len(args) == 2:
+		return eval(ctx, opts, args[1], out)
+	case args[0] == "bundle":
+		return bundle(opts, args[1:]...)
+	case args[0] == "unbundle" && len(args) == 3:
+		return unbundle(opts, args[1], args[2])
+	case args[0] == "restore" && len(args) == 1:
+		return mkcdj.New(opts.repo).Restore()
+	case args[0] == "doctor" && len(args) == 1:
+		return doctor.Run(ctx, out, cfg.Store)
+	case args[0] == "selftest" && len(args) == 1:
+		return selftest.Run(ctx, out)
 	default:
 		return errUsage
 	}
 }
 
-func analyze(ctx context.Context, preset, path string) error {
-	switch p, err := lookup(preset); {
+// readOnly are the commands accepting the repository from the standard input.
+var readOnly = map[string]bool{
+	"list":       true,
+	"search":     true,
+	"extract":    true,
+	"find":       true,
+	"files":      true,
+	"stats":      true,
+	"duplicates": true,
+	"verify":     true,
+	"names":      true,
+	"export-csv": true,
+	"export":     true,
+	"presets":    true,
+}
+
+// external are the commands running ffmpeg(1).
+var external = map[string]bool{
+	"analyze":     true,
+	"analyze-dir": true,
+	"compile":     true,
+	"refresh":     true,
+	"eval":        true,
+}
+
+func analyze(ctx context.Context, opts options, args ...string) error {
+	fs := flags("analyze")
+	warn := fs.Bool("warn-duplicate", false, "Keep the existing entry of an already analyzed audio content")
+	name := fs.String("name", "stdin", "Name of the track read from the standard input")
+	if err := fs.Parse(args); err != nil || fs.NArg() < 2 {
+		return errUsage
+	}
+
+	files := fs.Args()[1:]
+	if len(files) > 1 && slices.Contains(files, "-") {
+		return errUsage
+	}
+
+	o := opts.all
+	if *warn {
+		o = append(o, mkcdj.WithDuplicateWarnings())
+	}
+
+	switch p, err := lookup(opts, fs.Arg(0)); {
+	case err != nil:
+		return err
+	case len(files) > 1:
+		return mkcdj.New(append(o, progress)...).AnalyzeAll(ctx, files, p)
+	case files[0] == "-":
+		return mkcdj.New(o...).AnalyzeReader(ctx, os.Stdin, *name, p)
+	default:
+		return mkcdj.New(o...).Analyze(ctx, files[0], p)
+	}
+}
+
+func analyzeDir(ctx context.Context, opts options, preset, dir string) error {
+	switch p, err := lookup(opts, preset); {
 	case err != nil:
 		return err
 	default:
-		return mkcdj.New(opts[:]...).Analyze(ctx, path, p)
+		return mkcdj.New(append(opts.all, progress)...).AnalyzeDir(ctx, dir, p)
 	}
 }
 
-func compile(ctx context.Context, path string) error { return mkcdj.New(opts[:]...).Compile(ctx, path) }
-func refresh(ctx context.Context) error              { return mkcdj.New(opts[:]...).Refresh(ctx) }
-func list(out io.Writer) error                       { return mkcdj.New(repo).List(out) }
-func files(out io.Writer) error                      { return mkcdj.New(repo).Files(out) }
-func prune() error                                   { return mkcdj.New(repo).Prune() }
+func presetsCmd(opts options, out io.Writer, args ...string) error {
+	fs := flags("presets")
+	asJSON := fs.Bool("json", false, "Print the presets as JSON")
+	check := fs.Bool("check", false, "Print the overlaps, gaps and inverted ranges of the presets")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || (*asJSON && *check) {
+		return errUsage
+	}
+
+	if *check {
+		for _, w := range mkcdj.ValidatePresets(mkcdj.New(opts.repo).Presets()) {
+			if _, err := fmt.Fprintln(out, w); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if *asJSON {
+		return mkcdj.WritePresetsJSON(out, mkcdj.New(opts.repo).Presets())
+	}
+
+	return mkcdj.ListPresets(out, mkcdj.New(opts.repo).Presets())
+}
+
+func importCSV(opts options, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return mkcdj.New(opts.repo).ImportCSV(in)
+}
+
+func eval(ctx context.Context, opts options, path string, out io.Writer) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return mkcdj.New(opts.all...).Evaluate(ctx, in, out)
+}
+
+func stats(opts options, out io.Writer) error {
+	s, err := mkcdj.New(opts.repo).Stats()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(out, s)
+	return err
+}
+
+func setFormat(opts options, id, format string) error {
+	if format == "default" {
+		format = ""
+	}
+	return mkcdj.New(opts.all...).SetFormat(id, format)
+}
+
+func setPreset(opts options, args ...string) error {
+	fs := flags("set-preset")
+	force := fs.Bool("force", false, "Ignore the BPM range of the preset")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 {
+		return errUsage
+	}
+
+	p, err := lookup(opts, fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	if *force {
+		return mkcdj.New(opts.repo).ForcePreset(fs.Arg(0), p)
+	}
+
+	return mkcdj.New(opts.repo).SetPreset(fs.Arg(0), p)
+}
+
+func bundle(opts options, args ...string) error {
+	fs := flags("bundle")
+	files := fs.Bool("files", false, "Include source audio files")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+
+	out, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := mkcdj.New(opts.repo).Bundle(out, *files); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+func unbundle(opts options, path, dir string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return mkcdj.New(opts.repo).Unbundle(in, dir)
+}
+
+func compile(ctx context.Context, opts options, out io.Writer, args ...string) error {
+	fs := flags("compile")
+	dedup := fs.Bool("dedup", false, "Hardlink tracks with identical audio content")
+	overwrite := fs.String("overwrite", "fail", "Existing destination files policy: fail, skip or overwrite")
+	failFast := fs.Bool("fail-fast", false, "Stop at the first error")
+	name := fs.String("dir", "", "Name of the output directory (* for a random part)")
+	force := fs.Bool("force", false, "Convert all tracks again, overwriting existing files")
+	sheet := fs.Bool("contact-sheet", false, "Combine the waveforms of each preset into a single picture")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+
+	policy, ok := policies[*overwrite]
+	if !ok {
+		return errUsage
+	}
+
+	o := append(opts.all, mkcdj.WithOverwritePolicy(policy), mkcdj.WithOutputDir(*name), progress)
+	if *dedup {
+		o = append(o, mkcdj.WithDeduplication())
+	}
+	if *failFast {
+		o = append(o, mkcdj.WithFailFast())
+	}
+	if *force {
+		o = append(o, mkcdj.WithRebuild(), mkcdj.WithOverwritePolicy(mkcdj.OverwriteExisting))
+	}
+	if *sheet {
+		o = append(o, mkcdj.WithContactSheet())
+	}
+
+	dir, err := mkcdj.New(o...).Compile(ctx, fs.Arg(0))
+	if dir != "" {
+		fmt.Fprintln(out, dir)
+	}
+
+	return err
+}
+
+func rebase(opts options, out io.Writer, from, to string) error {
+	n, err := mkcdj.New(opts.repo).Rebase(from, to)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "%d tracks rebased\n", n)
+	return err
+}
+
+// progress prints the number of processed tracks to the standard error.
+var progress = mkcdj.WithProgress(func(done, total int, _ mkcdj.Track) {
+	fmt.Fprintf(os.Stderr, "%d/%d\n", done, total)
+})
+
+var policies = map[string]mkcdj.OverwritePolicy{
+	"fail":      mkcdj.FailExisting,
+	"skip":      mkcdj.SkipExisting,
+	"overwrite": mkcdj.OverwriteExisting,
+}
+
+func export(opts options, dir string) error {
+	out, err := os.Create(filepath.Join(dir, "playlist.m3u8"))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := mkcdj.New(opts.all...).ExportM3U(out, dir); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+func refresh(ctx context.Context, opts options, args ...string) error {
+	fs := flags("refresh")
+	failFast := fs.Bool("fail-fast", false, "Stop at the first error without saving anything")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	o := append(opts.all, progress)
+	if *failFast {
+		o = append(o, mkcdj.WithFailFast())
+	}
+
+	return mkcdj.New(o...).Refresh(ctx)
+}
+
+func requality(ctx context.Context, opts options) error {
+	if _, err := exec.LookPath("sox"); err != nil {
+		return err
+	}
+
+	return mkcdj.New(append(opts.all, progress)...).Requality(ctx)
+}
+
+func files(opts options, out io.Writer, args ...string) error {
+	fs := flags("files")
+	null := fs.Bool("0", false, "Separate paths with a null character")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	if *null {
+		return mkcdj.New(opts.repo).Files(out, 0)
+	}
+
+	return mkcdj.New(opts.repo).Files(out, '\n')
+}
+
+func list(opts options, out io.Writer, args ...string) error {
+	fs := flags("list")
+	asJSON := fs.Bool("json", false, "Print the tracks as JSON")
+	asNDJSON := fs.Bool("ndjson", false, "Print the tracks as JSON, one per line")
+	status := fs.String("status", "", "Only show tracks of the given status: good, warn or fail")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	if (*asJSON && *asNDJSON) || ((*asJSON || *asNDJSON) && *status != "") {
+		return errUsage
+	}
+
+	switch {
+	case *asJSON:
+		return mkcdj.New(opts.repo).ListJSON(out)
+	case *asNDJSON:
+		return mkcdj.New(opts.repo).ListNDJSON(out)
+	case *status != "":
+		return mkcdj.New(opts.repo).ListStatus(out, *status)
+	default:
+		return mkcdj.New(opts.repo).List(out)
+	}
+}
+
+func search(opts options, out io.Writer, args ...string) error {
+	var filter mkcdj.Filter
+
+	fs := flags("search")
+	fs.StringVar(&filter.Preset, "preset", "", "Only show tracks of the given preset")
+	fs.Float64Var(&filter.Min, "min", 0, "Minimum BPM (inclusive)")
+	fs.Float64Var(&filter.Max, "max", 0, "Maximum BPM (inclusive)")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	return mkcdj.New(opts.repo).Search(out, filter)
+}
+
+func extract(opts options, stdout io.Writer, args ...string) error {
+	var filter mkcdj.Filter
+
+	fs := flags("extract")
+	fs.StringVar(&filter.Preset, "preset", "", "Only extract tracks of the given preset")
+	fs.Float64Var(&filter.Min, "min", 0, "Minimum BPM (inclusive)")
+	fs.Float64Var(&filter.Max, "max", 0, "Maximum BPM (inclusive)")
+	path := fs.String("o", "", "Path of the new store (standard output if empty)")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	if *path == "" {
+		return mkcdj.New(opts.repo).Extract(stdout, filter)
+	}
+
+	out, err := os.Create(*path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := mkcdj.New(opts.repo).Extract(out, filter); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+func find(opts options, out io.Writer, args ...string) error {
+	fs := flags("find")
+	format := fs.String("format", "", "Only show tracks of the given audio format")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	match := func(t mkcdj.Track) bool { return *format == "" || t.Encoding() == *format }
+
+	return mkcdj.New(opts.repo).Find(out, match)
+}
+
+func prune(opts options, out io.Writer, args ...string) error {
+	fs := flags("prune")
+	preset := fs.String("preset", "", "Remove the tracks of the given preset")
+	dry := fs.Bool("n", false, "Print the tracks to remove without removing them")
+	yes := fs.Bool("y", false, "Remove the tracks without asking for confirmation")
+	below := fs.Float64("quality-below", 0, fmt.Sprintf("Remove the tracks with a quality score below the given one (usually %g)", quality.Threshold))
+	unscored := fs.Bool("unscored", false, "Also remove the tracks without a quality score")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	var lo bool
+	fs.Visit(func(f *flag.Flag) { lo = lo || f.Name == "quality-below" })
+
+	if lo && *preset != "" || !lo && *unscored {
+		return errUsage
+	}
+
+	var match func(mkcdj.Track) bool
+	switch {
+	case lo:
+		match = mkcdj.BelowQuality(*below, *unscored)
+	case *preset != "":
+		p, err := mkcdj.New(opts.repo).PresetFromName(*preset)
+		if err != nil {
+			return err
+		}
+		match = func(t mkcdj.Track) bool { return t.Preset.Name == p.Name }
+	default:
+		// Lost tracks can't be compiled anyway: no confirmation needed.
+		return mkcdj.New(opts.repo).Remove(out, mkcdj.Lost, *dry)
+	}
+
+	if *dry || *yes {
+		return mkcdj.New(opts.repo).Remove(out, match, *dry)
+	}
+
+	matched := bytes.NewBuffer(nil)
+	if err := mkcdj.New(opts.repo).Remove(matched, match, true); err != nil {
+		return err
+	}
+
+	n := bytes.Count(matched.Bytes(), []byte("\n"))
+	if n == 0 {
+		return nil
+	}
+
+	if _, err := io.Copy(out, matched); err != nil {
+		return err
+	}
+
+	if !confirm(os.Stdin, os.Stderr, fmt.Sprintf("Remove %d tracks?", n)) {
+		return errors.New("prune: aborted")
+	}
+
+	return mkcdj.New(opts.repo).Remove(io.Discard, match, false)
+}
+
+// confirm asks a question on out and reports whether the answer read from in
+// is yes. Anything else, including no answer, is a no.
+func confirm(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprintf(out, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
 
 const help string = `invalid parameters
 usage:
-  mkcdj [-v] analyze PRESET AUDIO_FILE
-  mkcdj [-v] compile DEST_DIRECTORY
-  mkcdj [-v] refresh
-  mkcdj [-v] list
-  mkcdj [-v] files
-  mkcdj [-v] prune`
+  mkcdj [-v] [-store STORE_FILE] analyze [-warn-duplicate] [-name NAME] PRESET AUDIO_FILE...
+  mkcdj [-v] [-store STORE_FILE] analyze-dir PRESET DIRECTORY
+  mkcdj [-v] [-store STORE_FILE] compile [-dedup] [-overwrite POLICY] [-fail-fast] [-dir NAME] [-force] [-contact-sheet] DEST_DIRECTORY
+  mkcdj [-v] [-store STORE_FILE] export AUDIO_DIRECTORY
+  mkcdj [-v] [-store STORE_FILE] export-csv
+  mkcdj [-v] [-store STORE_FILE] import-csv CSV_FILE
+  mkcdj [-v] [-store STORE_FILE] refresh [-fail-fast]
+  mkcdj [-v] [-store STORE_FILE] requality
+  mkcdj [-v] [-store STORE_FILE] list [-json | -ndjson | -status STATUS]
+  mkcdj [-v] [-store STORE_FILE] search [-preset NAME] [-min BPM] [-max BPM]
+  mkcdj [-v] [-store STORE_FILE] extract [-preset NAME] [-min BPM] [-max BPM] [-o STORE_FILE]
+  mkcdj [-v] [-store STORE_FILE] find [-format FORMAT]
+  mkcdj [-v] [-store STORE_FILE] files [-0]
+  mkcdj [-v] [-store STORE_FILE] stats
+  mkcdj [-v] [-store STORE_FILE] duplicates
+  mkcdj [-v] [-store STORE_FILE] verify
+  mkcdj [-v] [-store STORE_FILE] names
+  mkcdj [-v] [-store STORE_FILE] prune [-n]
+  mkcdj [-v] [-store STORE_FILE] prune -preset NAME [-n | -y]
+  mkcdj [-v] [-store STORE_FILE] prune -quality-below SCORE [-unscored] [-n | -y]
+  mkcdj [-v] [-store STORE_FILE] presets [-json | -check]
+  mkcdj [-v] [-store STORE_FILE] eval CSV_FILE
+  mkcdj [-v] [-store STORE_FILE] rebase OLD_PREFIX NEW_PREFIX
+  mkcdj [-v] [-store STORE_FILE] set-format PATH_OR_HASH FORMAT
+  mkcdj [-v] [-store STORE_FILE] set-preset [-force] PATH_OR_HASH PRESET
+  mkcdj [-v] [-store STORE_FILE] bundle [-files] OUT_FILE
+  mkcdj [-v] [-store STORE_FILE] unbundle IN_FILE DIRECTORY
+  mkcdj [-v] [-store STORE_FILE] restore
+  mkcdj [-v] [-store STORE_FILE] doctor
+  mkcdj [-v] [-store STORE_FILE] selftest`
 
 var errUsage = errors.New(help)
 
-var repo = mkcdj.WithRepository(env("MKCDJ_STORE", "/tmp/mkcdj.json"))
+// Config is the configuration of the command line, read from the flags and
+// the environment.
+type Config struct {
+	Store       string
+	BaseDir     string // Of relative track paths, empty means absolute ones.
+	Encoding    mkcdj.StoreFormat
+	Backups     int
+	NoLock      bool
+	Presets     []mkcdj.Preset // Nil means the default table.
+	Waveform    mkcdj.Pipeline // Nil means the default pipeline.
+	Spectrum    mkcdj.Pipeline // Nil means the default pipeline.
+	Loudness    float64        // Target in LUFS, zero disables normalization.
+	Format      string
+	Sidecars    bool
+	Folding     bool // Of BPMs detected at half or double the tempo.
+	Timeout     time.Duration
+	Deadline    time.Duration // Of refresh and compile, zero means none.
+	Retries     int
+	Backoff     time.Duration // Before the first retry.
+	Logger      *slog.Logger  // Nil discards the events.
+	Concurrency int
+	Repeats     int
+	SampleRate  int
+}
+
+// loadConfig reads the configuration from the flags and the environment.
+func loadConfig() (Config, error) {
+	cfg := Config{
+		Store:    store(),
+		BaseDir:  env("MKCDJ_BASE_DIR", ""),
+		Backups:  3,
+		NoLock:   env("MKCDJ_NOLOCK", "") != "",
+		Format:   env("MKCDJ_FORMAT", ""),
+		Sidecars: env("MKCDJ_SIDECARS", "") != "",
+		Folding:  env("MKCDJ_TEMPO_FOLDING", "") != "",
+		Timeout:  time.Minute,
+		Backoff:  time.Second,
+	}
+
+	var err error
+
+	if *verbose {
+		cfg.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+
+	if cfg.Encoding, err = mkcdj.StoreFormatFromName(env("MKCDJ_STORE_FORMAT", "json")); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Presets, err = loadPresets(); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Waveform, cfg.Spectrum, err = loadImages(); err != nil {
+		return cfg, err
+	}
+
+	for _, v := range [...]struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"MKCDJ_TIMEOUT", &cfg.Timeout},
+		{"MKCDJ_DEADLINE", &cfg.Deadline},
+		{"MKCDJ_RETRY_BACKOFF", &cfg.Backoff},
+	} {
+		val, ok := os.LookupEnv(v.name)
+		if !ok {
+			continue
+		}
+		if *v.dst, err = time.ParseDuration(val); err != nil {
+			return cfg, fmt.Errorf("invalid %s %q: %w", v.name, val, err)
+		}
+	}
+
+	for _, v := range [...]struct {
+		name string
+		dst  any
+	}{
+		{"MKCDJ_BACKUPS", &cfg.Backups},
+		{"MKCDJ_LOUDNESS", &cfg.Loudness},
+		{"MKCDJ_CONCURRENCY", &cfg.Concurrency},
+		{"MKCDJ_RETRIES", &cfg.Retries},
+		{"MKCDJ_SCAN_REPEATS", &cfg.Repeats},
+		{"MKCDJ_SAMPLE_RATE", &cfg.SampleRate},
+	} {
+		if err := scan(v.name, "%v", v.dst); err != nil {
+			return cfg, err
+		}
+	}
+
+	if cfg.Loudness != 0 {
+		if _, err := loudness(cfg.Loudness); err != nil {
+			return cfg, err
+		}
+	}
+
+	if cfg.SampleRate != 0 {
+		if _, err := sampleRate(cfg.SampleRate); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// store returns the path of the repository: the -store flag, MKCDJ_STORE or a
+// default location, in this order.
+func store() string {
+	if *storePath != "" {
+		return *storePath
+	}
+	return env("MKCDJ_STORE", "/tmp/mkcdj.json")
+}
+
+// options are the options of the playlist of a command, built from the
+// configuration by run.
+type options struct {
+	repo mkcdj.Option   // Configures the repository only.
+	all  []mkcdj.Option // Configures the whole playlist.
+}
+
+// repository configures the repository, its format, its backups, its locking,
+// the base directory of its paths, the preset table and the logger.
+func repository(cfg Config) mkcdj.Option {
+	return func(list *mkcdj.Playlist) {
+		mkcdj.WithRepository(cfg.Store)(list)
+		mkcdj.WithBackups(cfg.Backups)(list)
+		mkcdj.WithLocking(!cfg.NoLock)(list)
+		mkcdj.WithStoreFormat(cfg.Encoding)(list)
+		if cfg.Presets != nil {
+			mkcdj.WithPresets(cfg.Presets)(list)
+		}
+		if cfg.Logger != nil {
+			mkcdj.WithLogger(cfg.Logger)(list)
+		}
+		if cfg.BaseDir != "" {
+			mkcdj.WithBaseDir(cfg.BaseDir)(list)
+		}
+	}
+}
+
+// buildOptions returns the options of a playlist given the configuration.
+// The first one configures the repository only.
+func buildOptions(cfg Config) ([]mkcdj.Option, error) {
+	waveform, spectrum := cfg.Waveform, cfg.Spectrum
+	if waveform == nil {
+		waveform = mkcdj.PipelineFunc(ffmpeg.PNGWaveform)
+	}
+	if spectrum == nil {
+		spectrum = mkcdj.PipelineFunc(ffmpeg.PNGSpectrum)
+	}
+
+	o := []mkcdj.Option{
+		repository(cfg),
+		mkcdj.WithPipeline(mkcdj.Analyze, mkcdj.PipelineFunc(ffmpeg.F32LE)),
+		mkcdj.WithPipeline(mkcdj.Convert, mkcdj.PipelineFunc(ffmpeg.AudioOut)),
+		mkcdj.WithPipeline(mkcdj.Waveform, waveform),
+		mkcdj.WithPipeline(mkcdj.Spectrum, spectrum),
+		mkcdj.WithFormat("flac", mkcdj.PipelineFunc(ffmpeg.FLACOut)),
+		mkcdj.WithFormat("mp3", mkcdj.PipelineFunc(ffmpeg.MP3Out)),
+		mkcdj.WithFormat("m4a", mkcdj.PipelineFunc(ffmpeg.AACOut)),
+		mkcdj.WithBPMScanContextFunc(bpm.ScanContext),
+		mkcdj.WithKeyScanFunc(key.Scan),
+		mkcdj.WithCodecProbeFunc(ffmpeg.Codec),
+		mkcdj.WithTagsProbeFunc(tags),
+		mkcdj.WithLoudnessScanFunc(ffmpeg.Loudness),
+		mkcdj.WithMontageFunc(ffmpeg.ContactSheet),
+		mkcdj.WithConvertFormat(cfg.Format),
+		mkcdj.WithTimeout(cfg.Timeout),
+		mkcdj.WithDeadline(cfg.Deadline),
+		scoring(),
+	}
+
+	if cfg.Loudness != 0 {
+		n, err := loudness(cfg.Loudness)
+		if err != nil {
+			return nil, err
+		}
+		o = append(o, n)
+	}
+
+	if cfg.Sidecars {
+		o = append(o, mkcdj.WithSidecars())
+	}
+
+	if cfg.Folding {
+		o = append(o, mkcdj.WithTempoFolding())
+	}
+
+	if cfg.Concurrency > 0 {
+		o = append(o, mkcdj.WithConcurrency(cfg.Concurrency))
+	}
+
+	if cfg.Retries > 0 {
+		o = append(o, mkcdj.WithRetries(cfg.Retries, cfg.Backoff))
+	}
+
+	if cfg.Repeats > 1 {
+		o = append(o, mkcdj.WithScanRepeats(cfg.Repeats))
+	}
+
+	if cfg.SampleRate != 0 {
+		r, err := sampleRate(cfg.SampleRate)
+		if err != nil {
+			return nil, err
+		}
+		o = append(o, r)
+	}
+
+	return slices.Clip(o), nil
+}
+
+func loadPresets() ([]mkcdj.Preset, error) {
+	path, ok := os.LookupEnv("MKCDJ_PRESETS")
+	if !ok {
+		return nil, nil
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return mkcdj.LoadPresets(fd)
+}
+
+// loadImages returns the image pipelines, configured from the environment.
+func loadImages() (mkcdj.Pipeline, mkcdj.Pipeline, error) {
+	width, height := ffmpeg.WaveformWidth, ffmpeg.WaveformHeight
+	if err := scan("MKCDJ_WAVEFORM_SIZE", "%dx%d", &width, &height); err != nil {
+		return nil, nil, err
+	}
+
+	w, err := ffmpeg.PNGWaveformOpts(width, height, env("MKCDJ_WAVEFORM_COLOR", ffmpeg.WaveformColor))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	width, height = ffmpeg.SpectrumWidth, ffmpeg.SpectrumHeight
+	if err := scan("MKCDJ_SPECTRUM_SIZE", "%dx%d", &width, &height); err != nil {
+		return nil, nil, err
+	}
+
+	start, stop := ffmpeg.SpectrumStart, ffmpeg.SpectrumStop
+	if err := scan("MKCDJ_SPECTRUM_RANGE", "%d-%d", &start, &stop); err != nil {
+		return nil, nil, err
+	}
 
-var opts = [...]mkcdj.Option{
-	repo,
-	mkcdj.WithPipeline(mkcdj.Analyze, mkcdj.PipelineFunc(ffmpeg.F32LE)),
-	mkcdj.WithPipeline(mkcdj.Convert, mkcdj.PipelineFunc(ffmpeg.AudioOut)),
-	mkcdj.WithPipeline(mkcdj.Waveform, mkcdj.PipelineFunc(ffmpeg.PNGWaveform)),
-	mkcdj.WithPipeline(mkcdj.Spectrum, mkcdj.PipelineFunc(ffmpeg.PNGSpectrum)),
-	mkcdj.WithBPMScanFunc(bpm.Scan),
+	s, err := ffmpeg.PNGSpectrumOpts(width, height, env("MKCDJ_SPECTRUM_PALETTE", ffmpeg.SpectrumPalette), start, stop)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return mkcdj.PipelineFunc(w), mkcdj.PipelineFunc(s), nil
 }
 
-func lookup(name string) (mkcdj.Preset, error) {
+// loudness replaces the audio output pipelines with normalized ones.
+func loudness(target float64) (mkcdj.Option, error) {
+	pipelines := make(map[string]mkcdj.Pipeline)
+	for _, format := range [...]string{"wav", "flac", "mp3", "m4a"} {
+		f, err := ffmpeg.Normalized(format, target)
+		if err != nil {
+			return nil, err
+		}
+		pipelines[format] = mkcdj.PipelineFunc(f)
+	}
+
+	return func(list *mkcdj.Playlist) {
+		for format, p := range pipelines {
+			if format == "wav" {
+				mkcdj.WithPipeline(mkcdj.Convert, p)(list)
+			} else {
+				mkcdj.WithFormat(format, p)(list)
+			}
+		}
+	}, nil
+}
+
+// scan parses an environment variable with the given format, if set.
+func scan(name, format string, a ...any) error {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	if _, err := fmt.Sscanf(val, format, a...); err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	return nil
+}
+
+// sampleRate configures the analysis sample rate. The analyze pipeline and
+// the scanners being already set by buildOptions, they are replaced here.
+func sampleRate(n int) (mkcdj.Option, error) {
+	f, err := ffmpeg.F32LEOpts(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(list *mkcdj.Playlist) {
+		mkcdj.WithSampleRate(n)(list)
+		mkcdj.WithPipeline(mkcdj.Analyze, mkcdj.PipelineFunc(f))(list)
+		mkcdj.WithBPMScanContextFunc(bpm.Config{Rate: n}.ScanContext)(list)
+		mkcdj.WithKeyScanFunc(key.Config{Rate: n}.Scan)(list)
+	}, nil
+}
+
+// tags reads the artist and title of a file with ffprobe(1).
+func tags(ctx context.Context, path string) (mkcdj.Tags, error) {
+	m, err := ffmpeg.Probe(ctx, path)
+	return mkcdj.Tags{Artist: m.Artist, Title: m.Title}, err
+}
+
+// scoring enables quality scoring if sox(1) is available.
+func scoring() mkcdj.Option {
+	if _, err := exec.LookPath("sox"); err != nil {
+		return func(*mkcdj.Playlist) {}
+	}
+	return mkcdj.WithQualityScanFunc(quality.Scan)
+}
+
+func lookup(opts options, name string) (mkcdj.Preset, error) {
 	switch bpm, err := strconv.ParseFloat(name, 64); {
+	case name == mkcdj.Auto.Name:
+		return mkcdj.Auto, nil
 	case err == nil:
-		return mkcdj.PresetFromBPM(bpm)
+		return mkcdj.New(opts.repo).PresetFromBPM(bpm)
 	default:
-		return mkcdj.PresetFromName(name)
+		return mkcdj.New(opts.repo).PresetFromName(name)
 	}
 }
 
+// flags returns a flag set for command-specific flags. Errors are reported as
+// usage errors by the caller.
+func flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
 func env(name, fallback string) string {
 	if val, ok := os.LookupEnv(name); ok {
 		return val
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want string
+		err  error
+	}{
+		{nil, "", errUsage},
+		{[]string{"unknown"}, "", errUsage},
+		{[]string{"list"}, "[good] [default] [100] [--] [00:00] [flac] [--] [--] kept.flac\n" +
+			"[fail] [default] [110] [--] [00:00] [flac] [--] [--] lost.flac\n", nil},
+		{[]string{"list", "extra"}, "", errUsage},
+		{[]string{"files"}, "kept.flac\nlost.flac\n", nil},
+		{[]string{"files", "-0"}, "kept.flac\x00lost.flac\x00", nil},
+		{[]string{"files", "extra"}, "", errUsage},
+		{[]string{"stats", "extra"}, "", errUsage},
+		{[]string{"verify", "extra"}, "", errUsage},
+		{[]string{"names"}, "kept.flac -> audio/default/100 - kept.wav\n" +
+			"lost.flac -> audio/default/110 - lost.wav\n", nil},
+		{[]string{"names", "extra"}, "", errUsage},
+		{[]string{"set-format", "kept.flac"}, "", errUsage},
+		{[]string{"prune", "extra"}, "", errUsage},
+		{[]string{"prune", "-n"}, "[fail] [default] [110] [--] [00:00] [flac] [--] [--] lost.flac\n", nil},
+		{[]string{"prune", "-preset", "default", "-quality-below", "0.1"}, "", errUsage},
+		{[]string{"prune", "-quality"}, "", errUsage},
+		{[]string{"prune", "-unscored"}, "", errUsage},
+	} {
+		t.Run(fmt.Sprint(test.args), func(t *testing.T) {
+			t.Parallel()
+
+			cfg, dir := setup(t)
+
+			out := bytes.NewBuffer(nil)
+			if err := run(out, cfg, test.args...); !errors.Is(err, test.err) {
+				t.Fatalf("want: %v, got: %v", test.err, err)
+			}
+
+			assert(t, test.want, string(bytes.ReplaceAll(out.Bytes(), []byte(dir+"/"), nil)))
+		})
+	}
+}
+
+func TestRunPrune(t *testing.T) {
+	cfg, dir := setup(t)
+
+	noerr(t, run(bytes.NewBuffer(nil), cfg, "prune"))
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, run(out, cfg, "files"))
+	assert(t, filepath.Join(dir, "kept.flac")+"\n", out.String())
+}
+
+func TestRunPruneFilters(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"prune", "-preset", "default", "-n"}, "kept.flac\nlost.flac\n"},
+		{[]string{"prune", "-quality-below", "0.2", "-unscored", "-n"}, "kept.flac\nlost.flac\n"},
+		{[]string{"prune", "-quality-below", "0.1", "-y"}, "kept.flac\nlost.flac\n"},
+		{[]string{"prune", "-preset", "default", "-y"}, ""},
+		{[]string{"prune", "-quality-below", "0.2", "-unscored", "-y"}, ""},
+	} {
+		t.Run(fmt.Sprint(test.args), func(t *testing.T) {
+			t.Parallel()
+
+			cfg, dir := setup(t)
+
+			noerr(t, run(bytes.NewBuffer(nil), cfg, test.args...))
+
+			out := bytes.NewBuffer(nil)
+			noerr(t, run(out, cfg, "files"))
+			assert(t, test.want, string(bytes.ReplaceAll(out.Bytes(), []byte(dir+"/"), nil)))
+		})
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	for answer, want := range map[string]bool{"y\n": true, "YES\n": true, "n\n": false, "\n": false, "": false} {
+		if got := confirm(strings.NewReader(answer), io.Discard, "Remove?"); got != want {
+			t.Errorf("%q: want: %v, got: %v", answer, want, got)
+		}
+	}
+}
+
+func TestRunRebase(t *testing.T) {
+	cfg, dir := setup(t)
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, run(out, cfg, "rebase", dir, "/mnt/new"))
+	assert(t, "2 tracks rebased\n", out.String())
+
+	out.Reset()
+	noerr(t, run(out, cfg, "files"))
+	assert(t, "/mnt/new/kept.flac\n/mnt/new/lost.flac\n", out.String())
+}
+
+func TestRunStdin(t *testing.T) {
+	cfg, _ := setup(t)
+	cfg.Store = "-"
+
+	if err := run(bytes.NewBuffer(nil), cfg, "prune"); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	for _, env := range [][2]string{
+		{"MKCDJ_SAMPLE_RATE", "-48000"},
+		{"MKCDJ_SAMPLE_RATE", "fast"},
+		{"MKCDJ_LOUDNESS", "-100"},
+	} {
+		t.Run(env[0]+"="+env[1], func(t *testing.T) {
+			t.Setenv(env[0], env[1])
+
+			if _, err := loadConfig(); err == nil {
+				t.Error("want: error, got: nil")
+			}
+		})
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	cfg, _ := setup(t)
+	cfg.SampleRate = -48000
+
+	if err := run(bytes.NewBuffer(nil), cfg, "list"); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
+
+// setup returns the configuration of a repository holding two tracks: one
+// whose file exists and one whose file is lost.
+func setup(t *testing.T) (Config, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	kept, lost := filepath.Join(dir, "kept.flac"), filepath.Join(dir, "lost.flac")
+
+	noerr(t, os.WriteFile(kept, []byte("hello\n"), 0666))
+
+	store := filepath.Join(dir, "mkcdj.json")
+	noerr(t, os.WriteFile(store, []byte(fmt.Sprintf(`[
+		{"path": %q, "hash": "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", "preset": "default", "bpm": 100},
+		{"path": %q, "hash": "0000000000000000000000000000000000000000000000000000000000000000", "preset": "default", "bpm": 110}
+	]`, kept, lost)), 0666))
+
+	return Config{Store: store}, dir
+}
+
+func assert(t *testing.T, want, got string) {
+	t.Helper()
+	if want != got {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+}
+
+func noerr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
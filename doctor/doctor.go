@@ -0,0 +1,114 @@
+// Package doctor reports the status of the environment mkcdj runs in: the
+// external programs it depends on and the repository it writes to.
+package doctor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// check is a single probe of the environment. Only critical checks make Run
+// fail.
+type check struct {
+	name     string
+	critical bool
+	probe    func(context.Context) (string, error)
+}
+
+// Run executes every check and reports the outcome of each one to out.
+// It returns an error if at least one critical check failed.
+func Run(ctx context.Context, out io.Writer, store string) error {
+	checks := [...]check{
+		{"ffmpeg", true, binary("ffmpeg")},
+		{"ffprobe", true, binary("ffprobe")},
+		{"sox", false, binary("sox")},
+		{"ffmpeg version", false, version},
+		{"repository", true, repository(store)},
+	}
+
+	var failed int
+
+	for _, c := range checks {
+		res, err := c.probe(ctx)
+
+		var status string
+		switch {
+		case err == nil:
+			status = "ok"
+		case c.critical:
+			status, failed = "fail", failed+1
+		default:
+			status = "warn"
+		}
+
+		if err != nil {
+			res = err.Error()
+		}
+
+		if _, err := fmt.Fprintf(out, "[%s] %s: %s\n", status, c.name, res); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d critical checks failed", failed)
+	}
+
+	return nil
+}
+
+// binary returns a check resolving the path of a program.
+func binary(name string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return "", errors.New("not found in PATH")
+		}
+		return path, nil
+	}
+}
+
+// version returns the first line of the output of `ffmpeg -version`.
+func version(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, "ffmpeg", "-version").Output()
+	if err != nil {
+		return "", err
+	}
+
+	line, _, _ := bufio.NewReader(bytes.NewReader(out)).ReadLine()
+	return strings.TrimSpace(string(line)), nil
+}
+
+// repository returns a check telling whether the repository file can be read
+// and written, or created if it doesn't exist.
+func repository(path string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		fd, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err == nil {
+			fd.Close()
+			return path + " (readable, writable)", nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+
+		tmp, err := os.CreateTemp(filepath.Dir(path), ".mkcdj-doctor-*")
+		if err != nil {
+			return "", fmt.Errorf("%s cannot be created: %w", path, err)
+		}
+		tmp.Close()
+		os.Remove(tmp.Name()) //nolint:errcheck
+
+		return path + " (missing, will be created)", nil
+	}
+}
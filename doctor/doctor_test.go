@@ -0,0 +1,54 @@
+package doctor_test
+
+import (
+	"bytes"
+	"context"
+	"mkcdj/doctor"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	bin := t.TempDir()
+	for _, name := range [...]string{"ffmpeg", "ffprobe"} {
+		script := "#!/bin/sh\necho '" + name + " version 6.1'\n"
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("PATH", bin)
+
+	store := filepath.Join(t.TempDir(), "mkcdj.json")
+
+	out := bytes.NewBuffer(nil)
+	if err := doctor.Run(context.Background(), out, store); err != nil {
+		t.Error(err)
+	}
+
+	for _, want := range [...]string{
+		"[ok] ffmpeg: " + filepath.Join(bin, "ffmpeg"),
+		"[warn] sox: not found in PATH",
+		"[ok] ffmpeg version: ffmpeg version 6.1",
+		"[ok] repository: " + store + " (missing, will be created)",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("want: %s, got: %s", want, out)
+		}
+	}
+}
+
+func TestMissing(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	out := bytes.NewBuffer(nil)
+	if err := doctor.Run(context.Background(), out, filepath.Join(t.TempDir(), "mkcdj.json")); err == nil {
+		t.Error("want: error, got: nil")
+	}
+
+	if !strings.Contains(out.String(), "[fail] ffmpeg: not found in PATH") {
+		t.Errorf("want: ffmpeg failure, got: %s", out)
+	}
+}
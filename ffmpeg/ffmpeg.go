@@ -2,34 +2,371 @@
 package ffmpeg
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
 )
 
 var (
-	a = [...]string{"-v", "quiet", "-y", "-f", "f32le", "-ac", "1", "-ar", "44100"}
-	b = [...]string{"-v", "quiet", "-y", "-f", "wav", "-map_metadata", "-1", "-bitexact", "-ac", "2", "-ar", "44100"}
-	c = [...]string{"-v", "quiet", "-y", "-lavfi", "showwavespic=s=4096x2048:colors=#5294E2", "-f", "image2"}
-	d = [...]string{"-v", "quiet", "-y", "-lavfi", "showspectrumpic=s=4096x2048:color=cool:start=0:stop=24000", "-f", "image2"}
+	a = [...]string{"-v", "error", "-nostats", "-y", "-f", "f32le", "-ac", "1", "-ar", "44100"}
+	b = [...]string{"-v", "error", "-nostats", "-y", "-f", "wav", "-map_metadata", "-1", "-bitexact", "-ac", "2", "-ar", "44100"}
+	e = [...]string{"-v", "error", "-nostats", "-y", "-f", "flac", "-map_metadata", "-1", "-ac", "2", "-ar", "44100"}
+	f = [...]string{"-v", "error", "-nostats", "-y", "-f", "mp3", "-map_metadata", "-1", "-ac", "2", "-ar", "44100", "-b:a", "320k"}
+	g = [...]string{"-v", "error", "-nostats", "-y", "-f", "ipod", "-map_metadata", "-1", "-ac", "2", "-ar", "44100", "-c:a", "aac", "-b:a", "256k", "-movflags", "frag_keyframe+empty_moov"}
 )
 
+// Check returns an error naming the first of ffmpeg(1) and ffprobe(1) not
+// found in the PATH.
+func Check() error {
+	for _, name := range [...]string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Errorf("missing dependency: %s", name)
+		}
+	}
+	return nil
+}
+
+// TargetLUFS is the default integrated loudness target of Normalized, in LUFS.
+const TargetLUFS = -14.0
+
+// outputs are the arguments of the audio output pipelines by file format.
+var outputs = map[string][]string{"wav": b[:], "flac": e[:], "mp3": f[:], "m4a": g[:]}
+
+// Normalized returns the audio output pipeline of the given format (wav, flac,
+// mp3 or m4a) applying a single-pass EBU R128 loudness normalization to the
+// target integrated loudness, for example TargetLUFS.
+func Normalized(format string, target float64) (func(context.Context, io.Reader, io.Writer, io.Writer) error, error) {
+	args, ok := outputs[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported output format: %s", format)
+	}
+
+	if target < -70 || target > -5 {
+		return nil, fmt.Errorf("invalid loudness target: %g LUFS", target)
+	}
+
+	// The output file name is appended last, after the filter.
+	args = append(slices.Clip(args), "-af", fmt.Sprintf("loudnorm=I=%g:TP=-1.5:LRA=11", target))
+
+	return func(ctx context.Context, in io.Reader, out, err io.Writer) error {
+		return command(ctx, in, out, err, args...).Run()
+	}, nil
+}
+
 func F32LE(ctx context.Context, in io.Reader, out, err io.Writer) error {
 	return command(ctx, in, out, err, a[:]...).Run()
 }
 
+// F32LEOpts returns an analysis pipeline resampling the signal at the given
+// rate, in Hz, instead of 44100.
+func F32LEOpts(rate int) (func(context.Context, io.Reader, io.Writer, io.Writer) error, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("invalid sample rate: %d", rate)
+	}
+
+	args := slices.Clone(a[:])
+	args[len(args)-1] = strconv.Itoa(rate)
+
+	return func(ctx context.Context, in io.Reader, out, err io.Writer) error {
+		return command(ctx, in, out, err, args...).Run()
+	}, nil
+}
+
 func AudioOut(ctx context.Context, in io.Reader, out, err io.Writer) error {
 	return command(ctx, in, out, err, b[:]...).Run()
 }
 
+func FLACOut(ctx context.Context, in io.Reader, out, err io.Writer) error {
+	return command(ctx, in, out, err, e[:]...).Run()
+}
+
+func MP3Out(ctx context.Context, in io.Reader, out, err io.Writer) error {
+	return command(ctx, in, out, err, f[:]...).Run()
+}
+
+func AACOut(ctx context.Context, in io.Reader, out, err io.Writer) error {
+	return command(ctx, in, out, err, g[:]...).Run()
+}
+
+// Default waveform image parameters.
+const (
+	WaveformWidth  = 4096
+	WaveformHeight = 2048
+	WaveformColor  = "#5294E2"
+)
+
+var waveform, _ = PNGWaveformOpts(WaveformWidth, WaveformHeight, WaveformColor)
+
 func PNGWaveform(ctx context.Context, in io.Reader, out, err io.Writer) error {
-	return command(ctx, in, out, err, c[:]...).Run()
+	return waveform(ctx, in, out, err)
+}
+
+// PNGWaveformOpts returns a waveform pipeline drawing an image of the given
+// dimensions in the given color (#RRGGBB or #RRGGBBAA).
+func PNGWaveformOpts(width, height int, color string) (func(context.Context, io.Reader, io.Writer, io.Writer) error, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid waveform dimensions: %dx%d", width, height)
+	}
+
+	if !hex(color) {
+		return nil, fmt.Errorf("invalid waveform color: %q", color)
+	}
+
+	c := []string{"-v", "error", "-nostats", "-y", "-lavfi", fmt.Sprintf("showwavespic=s=%dx%d:colors=%s", width, height, color), "-f", "image2"}
+
+	return func(ctx context.Context, in io.Reader, out, err io.Writer) error {
+		return command(ctx, in, out, err, c...).Run()
+	}, nil
 }
 
+// Default spectrogram image parameters.
+const (
+	SpectrumWidth   = 4096
+	SpectrumHeight  = 2048
+	SpectrumPalette = "cool"
+	SpectrumStart   = 0
+	SpectrumStop    = 24000
+)
+
+var spectrum, _ = PNGSpectrumOpts(SpectrumWidth, SpectrumHeight, SpectrumPalette, SpectrumStart, SpectrumStop)
+
 func PNGSpectrum(ctx context.Context, in io.Reader, out, err io.Writer) error {
-	return command(ctx, in, out, err, d[:]...).Run()
+	return spectrum(ctx, in, out, err)
+}
+
+// Palettes supported by the showspectrumpic filter.
+var palettes = [...]string{
+	"channel", "intensity", "rainbow", "moreland", "nebulae", "fire", "fiery",
+	"fruit", "cool", "magma", "green", "viridis", "plasma", "cividis", "terrain",
+}
+
+// PNGSpectrumOpts returns a spectrogram pipeline drawing an image of the given
+// dimensions with the given palette, from the start to the stop frequency in
+// Hz.
+func PNGSpectrumOpts(width, height int, palette string, start, stop int) (func(context.Context, io.Reader, io.Writer, io.Writer) error, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid spectrogram dimensions: %dx%d", width, height)
+	}
+
+	if !slices.Contains(palettes[:], palette) {
+		return nil, fmt.Errorf("invalid spectrogram palette: %q", palette)
+	}
+
+	if start < 0 || start >= stop || stop > SpectrumStop {
+		return nil, fmt.Errorf("invalid spectrogram frequency range: %d-%d", start, stop)
+	}
+
+	d := []string{"-v", "error", "-nostats", "-y", "-lavfi", fmt.Sprintf("showspectrumpic=s=%dx%d:color=%s:start=%d:stop=%d", width, height, palette, start, stop), "-f", "image2"}
+
+	return func(ctx context.Context, in io.Reader, out, err io.Writer) error {
+		return command(ctx, in, out, err, d...).Run()
+	}, nil
+}
+
+// Default contact sheet row dimensions.
+const (
+	ContactSheetWidth  = 1024
+	ContactSheetHeight = 128
+)
+
+// ContactSheet stacks pictures of the same format, scaled to rows of the
+// default dimensions, into a single PNG picture with the tile filter.
+func ContactSheet(ctx context.Context, paths []string, out, err io.Writer) error {
+	if len(paths) == 0 {
+		return errors.New("no pictures to combine")
+	}
+
+	args := []string{"-v", "error", "-nostats", "-y"}
+
+	var rows, labels strings.Builder
+	for i, path := range paths {
+		args = append(args, "-i", path)
+		fmt.Fprintf(&rows, "[%d:v]scale=%d:%d[r%d];", i, ContactSheetWidth, ContactSheetHeight, i)
+		fmt.Fprintf(&labels, "[r%d]", i)
+	}
+
+	graph := fmt.Sprintf("%s%sconcat=n=%d:v=1:a=0,tile=1x%d", rows.String(), labels.String(), len(paths), len(paths))
+
+	arg1, ok1 := pipe(out, 1)
+	args = append(args, "-filter_complex", graph, "-frames:v", "1", "-f", "image2", "-c:v", "png", arg1)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stderr = err
+
+	if ok1 {
+		cmd.Stdout = out
+	}
+
+	return cmd.Run()
+}
+
+// Codec returns the name of the codec of the first audio stream of a file.
+func Codec(ctx context.Context, path string) (string, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "quiet",
+		"-select_streams", "a:0",
+		"-show_entries", "stream=codec_name",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Loudness returns the integrated loudness of a file in LUFS, measured by the
+// EBU R128 filter.
+func Loudness(ctx context.Context, path string) (float64, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-nostats", "-hide_banner",
+		"-i", path,
+		"-af", "ebur128=framelog=quiet",
+		"-f", "null", "-")
+
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return 0, err
+	}
+
+	return ParseLoudness(stderr)
+}
+
+// ParseLoudness returns the integrated loudness from the summary printed by the
+// ebur128 filter, the last "I: <value> LUFS" line.
+func ParseLoudness(r io.Reader) (float64, error) {
+	var lufs string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "I:" && fields[2] == "LUFS" {
+			lufs = fields[1]
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if lufs == "" {
+		return 0, errors.New("no integrated loudness")
+	}
+
+	return strconv.ParseFloat(lufs, 64)
+}
+
+// hex reports whether a color is in the #RRGGBB or #RRGGBBAA form.
+func hex(color string) bool {
+	if !strings.HasPrefix(color, "#") || (len(color) != 7 && len(color) != 9) {
+		return false
+	}
+	_, err := strconv.ParseUint(color[1:], 16, 32)
+	return err == nil
+}
+
+// Metadata are the tags and properties of an audio file.
+type Metadata struct {
+	Artist   string
+	Title    string
+	Album    string
+	Duration float64 // Seconds.
+}
+
+// Probe returns the metadata of a file. Tags are looked up in the container
+// first, then in the audio streams (Ogg files store them there).
+func Probe(ctx context.Context, path string) (Metadata, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "quiet",
+		"-show_format", "-show_streams",
+		"-of", "json",
+		path)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	var res struct {
+		Format struct {
+			Duration string            `json:"duration"`
+			Tags     map[string]string `json:"tags"`
+		} `json:"format"`
+		Streams []struct {
+			Type string            `json:"codec_type"`
+			Tags map[string]string `json:"tags"`
+		} `json:"streams"`
+	}
+
+	if err := json.Unmarshal(out, &res); err != nil {
+		return Metadata{}, err
+	}
+
+	tags := []map[string]string{res.Format.Tags}
+	for _, s := range res.Streams {
+		if s.Type == "audio" {
+			tags = append(tags, s.Tags)
+		}
+	}
+
+	m := Metadata{
+		Artist: tag(tags, "artist"),
+		Title:  tag(tags, "title"),
+		Album:  tag(tags, "album"),
+	}
+
+	if res.Format.Duration != "" {
+		if m.Duration, err = strconv.ParseFloat(res.Format.Duration, 64); err != nil {
+			return Metadata{}, err
+		}
+	}
+
+	return m, nil
+}
+
+// tag returns the first non-empty value of a tag, whatever its case.
+func tag(tags []map[string]string, name string) string {
+	for _, t := range tags {
+		for k, v := range t {
+			if strings.EqualFold(k, name) && strings.TrimSpace(v) != "" {
+				return strings.TrimSpace(v)
+			}
+		}
+	}
+	return ""
+}
+
+// FromTemplate returns a pipeline running a shell command built from a
+// text/template executed with the given data, for example a custom ffmpeg
+// filtergraph using the preset bounds. The command reads the input on its
+// standard input and writes the output on its standard output.
+func FromTemplate(tpl string, data any) (func(context.Context, io.Reader, io.Writer, io.Writer) error, error) {
+	t, err := template.New("pipeline").Option("missingkey=error").Parse(tpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pipeline template: %w", err)
+	}
+
+	script := new(strings.Builder)
+	if err := t.Execute(script, data); err != nil {
+		return nil, fmt.Errorf("invalid pipeline template: %w", err)
+	}
+
+	return func(ctx context.Context, in io.Reader, out, err io.Writer) error {
+		cmd := exec.CommandContext(ctx, "sh", "-c", script.String())
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = in, out, err
+		return cmd.Run()
+	}, nil
 }
 
 func command(ctx context.Context, in io.Reader, out, err io.Writer, args ...string) *exec.Cmd {
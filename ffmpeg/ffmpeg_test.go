@@ -3,9 +3,12 @@ package ffmpeg_test
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"mkcdj/ffmpeg"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -13,10 +16,196 @@ import (
 func TestFFMPEG(t *testing.T) {
 	t.Run("analyze", run(ffmpeg.F32LE))
 	t.Run("convert", run(ffmpeg.AudioOut))
+	t.Run("flac", run(ffmpeg.FLACOut))
+	t.Run("mp3", run(ffmpeg.MP3Out))
+	t.Run("aac", run(ffmpeg.AACOut))
 	t.Run("waveform", run(ffmpeg.PNGWaveform))
 	t.Run("spectrum", run(ffmpeg.PNGSpectrum))
 }
 
+func TestCheck(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	if err := ffmpeg.Check(); err == nil || err.Error() != "missing dependency: ffmpeg" {
+		t.Errorf("want: missing dependency: ffmpeg, got: %v", err)
+	}
+}
+
+func TestNormalized(t *testing.T) {
+	for _, format := range [...]string{"wav", "flac"} {
+		f, err := ffmpeg.Normalized(format, ffmpeg.TargetLUFS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(format, run(f))
+	}
+
+	if _, err := ffmpeg.Normalized("ogg", ffmpeg.TargetLUFS); err == nil {
+		t.Error("want: error for unsupported format")
+	}
+
+	if _, err := ffmpeg.Normalized("wav", 0); err == nil {
+		t.Error("want: error for invalid target")
+	}
+}
+
+func TestFromTemplate(t *testing.T) {
+	f, err := ffmpeg.FromTemplate("cat; echo {{.Min}}-{{.Max}}", struct{ Min, Max int }{115, 130})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := f(context.Background(), bytes.NewBufferString("bpm:"), out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := out.String(); got != "bpm:115-130\n" {
+		t.Errorf("want: bpm:115-130, got: %q", got)
+	}
+
+	for _, tpl := range [...]string{"{{.Min", "{{.Unknown}}"} {
+		if _, err := ffmpeg.FromTemplate(tpl, struct{ Min int }{}); err == nil {
+			t.Errorf("%s: want: error, got: nil", tpl)
+		}
+	}
+}
+
+func TestPNGWaveformOpts(t *testing.T) {
+	for _, test := range []struct {
+		width, height int
+		color         string
+		valid         bool
+	}{
+		{1920, 480, "#FF8800", true},
+		{1920, 480, "#FF880080", true},
+		{0, 480, "#FF8800", false},
+		{1920, -1, "#FF8800", false},
+		{1920, 480, "FF8800", false},
+		{1920, 480, "#FF88GG", false},
+	} {
+		_, err := ffmpeg.PNGWaveformOpts(test.width, test.height, test.color)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%dx%d %s: want valid: %t, got: %v", test.width, test.height, test.color, test.valid, err)
+		}
+	}
+}
+
+func TestPNGSpectrumOpts(t *testing.T) {
+	for _, test := range []struct {
+		palette     string
+		start, stop int
+		valid       bool
+	}{
+		{"cool", 0, 24000, true},
+		{"magma", 20, 12000, true},
+		{"unknown", 0, 12000, false},
+		{"cool", 12000, 12000, false},
+		{"cool", 0, 48000, false},
+		{"cool", -1, 12000, false},
+	} {
+		_, err := ffmpeg.PNGSpectrumOpts(1920, 480, test.palette, test.start, test.stop)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s %d-%d: want valid: %t, got: %v", test.palette, test.start, test.stop, test.valid, err)
+		}
+	}
+}
+
+func TestContactSheet(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	paths := make([]string, 2)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("%d.png", i))
+
+		in, err := os.Open("./testdata/track.wav")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+
+		out, err := os.Create(paths[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+
+		if err := ffmpeg.PNGWaveform(ctx, in, out, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := ffmpeg.ContactSheet(ctx, paths, out, io.Discard); err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.HasPrefix(out.Bytes(), []byte("\x89PNG")) {
+		t.Error("want: PNG picture")
+	}
+
+	if err := ffmpeg.ContactSheet(ctx, nil, out, io.Discard); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
+
+func TestCodec(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	codec, err := ffmpeg.Codec(ctx, "./testdata/track.wav")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if codec != "pcm_s16le" {
+		t.Errorf("want: pcm_s16le, got: %s", codec)
+	}
+}
+
+func TestParseLoudness(t *testing.T) {
+	data := strings.Join([]string{
+		"[Parsed_ebur128_0 @ 0x5581] Summary:",
+		"",
+		"  Integrated loudness:",
+		"    I:         -16.9 LUFS",
+		"    Threshold: -27.2 LUFS",
+		"",
+		"  Loudness range:",
+		"    LRA:         4.1 LU",
+	}, "\n")
+
+	lufs, err := ffmpeg.ParseLoudness(strings.NewReader(data))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if lufs != -16.9 {
+		t.Errorf("want: -16.9, got: %f", lufs)
+	}
+
+	if _, err := ffmpeg.ParseLoudness(strings.NewReader("Press [q] to stop")); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	m, err := ffmpeg.Probe(ctx, "./testdata/track.wav")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.Duration <= 0 {
+		t.Errorf("want: positive duration, got: %f", m.Duration)
+	}
+}
+
 func run(f func(context.Context, io.Reader, io.Writer, io.Writer) error) func(t *testing.T) {
 	return func(t *testing.T) {
 		in, err := os.Open("./testdata/track.wav")
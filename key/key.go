@@ -0,0 +1,176 @@
+// Package key estimates the musical key of an audio file.
+// The signal is folded into a chromagram (energy per pitch class) which is
+// correlated with the Krumhansl-Schmuckler key profiles. Keys are expressed in
+// Camelot notation, as used for harmonic mixing.
+package key
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	Rate = 44100
+
+	// The signal is decimated before the pitch analysis.
+	Decimation = 4
+	Frame      = 4096
+
+	// Analyzed notes, as MIDI numbers (C2 to B6).
+	Low  = 36
+	High = 96
+)
+
+var (
+	major = [12]float64{6.35, 2.23, 3.48, 2.33, 4.38, 4.09, 2.52, 5.19, 2.39, 3.66, 2.29, 2.88}
+	minor = [12]float64{6.33, 2.68, 3.52, 5.38, 2.60, 3.53, 2.54, 4.75, 3.98, 2.69, 3.34, 3.17}
+)
+
+// Config holds the parameters of the key detection.
+type Config struct {
+	// Rate is the sample rate of the signal, in Hz. Zero means Rate.
+	Rate int
+}
+
+// Default is the configuration used by Scan and Chroma.
+var Default Config
+
+// Scan returns the key of audio data from a Reader containing f32le samples,
+// in Camelot notation (for example "8A" for A minor).
+func Scan(r io.Reader) (string, error) {
+	return Default.Scan(r)
+}
+
+// Chroma returns the energy of each pitch class (C, C#, ..., B) of audio data
+// from a Reader containing f32le samples.
+func Chroma(r io.Reader) ([12]float64, error) {
+	return Default.Chroma(r)
+}
+
+// Scan is like Scan using the given configuration.
+func (c Config) Scan(r io.Reader) (string, error) {
+	chroma, err := c.Chroma(r)
+	if err != nil {
+		return "", err
+	}
+
+	tonic, minor, err := estimate(chroma)
+	if err != nil {
+		return "", err
+	}
+
+	return Camelot(tonic, minor), nil
+}
+
+// Chroma is like Chroma using the given configuration.
+func (c Config) Chroma(r io.Reader) ([12]float64, error) {
+	var chroma [12]float64
+
+	if c.Rate < 0 {
+		return chroma, errors.New("sample rate must be positive")
+	}
+
+	rate := float64(c.Rate)
+	if rate == 0 {
+		rate = Rate
+	}
+
+	br := bufio.NewReaderSize(r, 1<<16)
+	frame := make([]float64, 0, Frame)
+
+	var b [4]byte
+	var sum float64
+	var n int
+
+	for {
+		switch _, err := io.ReadFull(br, b[:]); {
+		case errors.Is(err, io.EOF):
+			return chroma, nil
+		case err != nil:
+			return chroma, err
+		}
+
+		// Averaging consecutive samples acts as a crude low-pass filter.
+		sum += float64(math.Float32frombits(binary.LittleEndian.Uint32(b[:])))
+		if n++; n < Decimation {
+			continue
+		}
+
+		frame, sum, n = append(frame, sum/Decimation), 0, 0
+
+		if len(frame) == Frame {
+			accumulate(&chroma, frame, rate/Decimation)
+			frame = frame[:0]
+		}
+	}
+}
+
+// accumulate adds the energy of each analyzed note in a frame sampled at the
+// given rate to its pitch class using the Goertzel algorithm.
+func accumulate(chroma *[12]float64, frame []float64, rate float64) {
+	for note := Low; note < High; note++ {
+		freq := 440 * math.Pow(2, float64(note-69)/12)
+		coeff := 2 * math.Cos(2*math.Pi*freq/rate)
+
+		var s1, s2 float64
+		for _, x := range frame {
+			s1, s2 = x+coeff*s1-s2, s1
+		}
+
+		chroma[note%12] += math.Sqrt(max(0, s1*s1+s2*s2-coeff*s1*s2))
+	}
+}
+
+// estimate returns the tonic pitch class and mode of the key profile best
+// correlated with the chromagram.
+func estimate(chroma [12]float64) (int, bool, error) {
+	best, tonic, isMinor := math.Inf(-1), 0, false
+
+	for p := 0; p < 12; p++ {
+		for _, profile := range [...]struct {
+			weights [12]float64
+			minor   bool
+		}{{major, false}, {minor, true}} {
+			c := correlation(chroma, profile.weights, p)
+			if math.IsNaN(c) {
+				return 0, false, errors.New("not enough tonal content")
+			}
+			if c > best {
+				best, tonic, isMinor = c, p, profile.minor
+			}
+		}
+	}
+
+	return tonic, isMinor, nil
+}
+
+// correlation returns the Pearson correlation between the chromagram and a
+// key profile rotated to the given tonic.
+func correlation(chroma, profile [12]float64, tonic int) float64 {
+	var mx, my float64
+	for i := range chroma {
+		mx, my = mx+chroma[i]/12, my+profile[i]/12
+	}
+
+	var sxy, sxx, syy float64
+	for i := range chroma {
+		x, y := chroma[(i+tonic)%12]-mx, profile[i]-my
+		sxy, sxx, syy = sxy+x*y, sxx+x*x, syy+y*y
+	}
+
+	return sxy / math.Sqrt(sxx*syy)
+}
+
+// Camelot returns the Camelot notation of a key given its tonic pitch class
+// (0 for C) and mode.
+func Camelot(tonic int, minor bool) string {
+	if minor {
+		// Minor keys share their number with their relative major.
+		return fmt.Sprintf("%dA", (7*(tonic+3)+7)%12+1)
+	}
+	return fmt.Sprintf("%dB", (7*tonic+7)%12+1)
+}
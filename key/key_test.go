@@ -0,0 +1,75 @@
+package key_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"mkcdj/key"
+	"testing"
+)
+
+func TestCamelot(t *testing.T) {
+	for _, test := range []struct {
+		tonic int
+		minor bool
+		want  string
+	}{
+		{0, false, "8B"},  // C major.
+		{9, true, "8A"},   // A minor.
+		{7, false, "9B"},  // G major.
+		{5, false, "7B"},  // F major.
+		{0, true, "5A"},   // C minor.
+		{8, true, "1A"},   // G# minor.
+		{4, false, "12B"}, // E major.
+	} {
+		assert(t, test.want, key.Camelot(test.tonic, test.minor))
+	}
+}
+
+func TestScan(t *testing.T) {
+	// Ten seconds of an A minor chord with its bass note.
+	got, err := key.Scan(chord(10, 220, 261.63, 329.63, 110))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert(t, "8A", got)
+}
+
+func TestRate(t *testing.T) {
+	got, err := key.Config{Rate: 48000}.Scan(chordAt(48000, 10, 220, 261.63, 329.63, 110))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert(t, "8A", got)
+}
+
+func TestSilence(t *testing.T) {
+	if _, err := key.Scan(chord(2)); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
+
+func chord(seconds int, freqs ...float64) *bytes.Buffer {
+	return chordAt(key.Rate, seconds, freqs...)
+}
+
+func chordAt(rate, seconds int, freqs ...float64) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < seconds*rate; i++ {
+		var v float64
+		for _, f := range freqs {
+			v += math.Sin(2*math.Pi*f*float64(i)/float64(rate)) / float64(len(freqs))
+		}
+		binary.Write(buf, binary.LittleEndian, float32(v)) //nolint:errcheck
+	}
+	return buf
+}
+
+func assert(t *testing.T, want, got string) {
+	t.Helper()
+	if want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+}
@@ -1,42 +1,117 @@
 package mkcdj
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/sha256"
+	"encoding/csv"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"math"
+	"mkcdj/bpm"
+	"mkcdj/ffmpeg"
+	"mkcdj/key"
+	"mkcdj/quality"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode"
 )
 
 // Track is an audio track.
 type Track struct {
-	Path   string  `json:"path"`
-	Hash   string  `json:"hash"`
-	Preset Preset  `json:"preset"`
-	BPM    float64 `json:"bpm"`
+	Path     string  `json:"path"`
+	Hash     string  `json:"hash"`
+	Preset   Preset  `json:"preset"`
+	BPM      float64 `json:"bpm"`
+	Format   string  `json:"format,omitempty"`   // Output format override.
+	Codec    string  `json:"codec,omitempty"`    // Detected audio codec.
+	Duration float64 `json:"duration,omitempty"` // Seconds.
+	Quality  float64 `json:"quality,omitempty"`  // High-frequency score.
+	Scored   bool    `json:"scored,omitempty"`   // Quality was measured, even if 0.
+	LUFS     float64 `json:"lufs,omitempty"`     // Integrated loudness.
+	Key      string  `json:"key,omitempty"`      // Camelot notation.
+	Artist   string  `json:"artist,omitempty"`   // From the file tags.
+	Title    string  `json:"title,omitempty"`    // From the file tags.
+	Modified int64   `json:"mtime,omitempty"`    // Of the file when analyzed, Unix nanoseconds.
 }
 
 // String implements fmt.Stringer for Track.
 func (t Track) String() string {
-	return fmt.Sprintf("[%s] [%s] [%.0f] %s",
-		status(t), t.Preset.Name, math.Round(t.BPM), filepath.Base(t.Path))
+	d := int(math.Round(t.Duration))
+	key := t.Key
+	if key == "" {
+		key = "--"
+	}
+	lufs := "--"
+	if t.LUFS != 0 {
+		lufs = fmt.Sprintf("%.0f", t.LUFS)
+	}
+	return fmt.Sprintf("[%s] [%s] [%.0f] [%s] [%02d:%02d] [%s] [%s] [%s] %s",
+		status(t), t.Preset.Name, math.Round(t.BPM), key, d/60, d%60, t.Encoding(), fidelity(t), lufs, filepath.Base(t.Path))
+}
+
+// LogValue implements slog.LogValuer for Track.
+func (t Track) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("path", t.Path),
+		slog.String("preset", t.Preset.Name),
+		slog.Float64("bpm", t.BPM),
+		slog.String("status", status(t)),
+	)
+}
+
+// fidelity returns a marker of the quality score of a track.
+func fidelity(t Track) string {
+	switch {
+	case !scored(t):
+		return "--"
+	case t.Quality < quality.Threshold:
+		return "lo"
+	default:
+		return "hi"
+	}
+}
+
+// scored reports whether a track has a quality score. Tracks stored before
+// Scored existed only have a non-zero score.
+func scored(t Track) bool {
+	return t.Scored || t.Quality != 0
+}
+
+// Encoding returns the audio format of the source file. It is derived from
+// the detected codec when available, from the file extension otherwise.
+func (t Track) Encoding() string {
+	switch {
+	case strings.HasPrefix(t.Codec, "pcm_"):
+		return strings.TrimPrefix(wav, ".")
+	case t.Codec != "":
+		return t.Codec
+	default:
+		return strings.TrimPrefix(strings.ToLower(filepath.Ext(t.Path)), ".")
+	}
 }
 
 // Presets is the list of available presets.
 // It must have at least one element being the default preset at index 0.
-var Presets = [...]Preset{
+// Use RegisterPreset to add presets to it.
+var Presets = []Preset{
 	{"default", 40, 220}, // Largo to Prestissimo.
 
 	{"dnb", 165, 179.99},
@@ -56,7 +131,9 @@ type Preset struct {
 }
 
 // UnmarshalJSON implements json.Unmarshaler for Preset.
-// If the preset is empty, the default preset is silently returned.
+// If the preset is empty, the default preset is silently returned. Presets
+// unknown to the built-in table only carry their name until a Playlist
+// resolves them against its configured presets.
 func (p *Preset) UnmarshalJSON(data []byte) error {
 	var name string
 	if err := json.Unmarshal(data, &name); err != nil {
@@ -69,8 +146,11 @@ func (p *Preset) UnmarshalJSON(data []byte) error {
 	}
 
 	var err error
-	*p, err = PresetFromName(name)
-	return err
+	if *p, err = PresetFromName(name); err != nil {
+		*p = Preset{Name: name}
+	}
+
+	return nil
 }
 
 // MarshalJSON implements json.Marshaler for Preset.
@@ -85,12 +165,202 @@ func (p Preset) Range() (string, string) {
 	return fmt.Sprintf("%.0f", min), fmt.Sprintf("%.0f", max)
 }
 
-// PresetFromBPM returns the Preset with the narrowest BPM range matching the given value.
+// ListPresets prints a preset table as name [min-max] lines sorted by minimum
+// BPM.
+func ListPresets(out io.Writer, presets []Preset) error {
+	sorted := append([]Preset(nil), presets...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Min < sorted[j].Min })
+
+	for _, p := range sorted {
+		min, max := p.Range()
+		if _, err := fmt.Fprintf(out, "%s [%s-%s]\n", p.Name, min, max); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WritePresetsJSON writes a preset table as a JSON array of objects with the
+// name and the BPM range of each preset.
+func WritePresetsJSON(out io.Writer, presets []Preset) error {
+	res := make([]presetJSON, 0, len(presets))
+	for _, p := range presets {
+		res = append(res, presetJSON(p))
+	}
+
+	return json.NewEncoder(out).Encode(res)
+}
+
+// presetJSON is the JSON representation of a preset table entry.
+type presetJSON struct {
+	Name string  `json:"name"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+}
+
+// LoadPresets parses a custom preset table, either as a JSON array of objects
+// with name, min and max fields, or as CSV records of name,min,max. The first
+// preset is used as the default one.
+func LoadPresets(r io.Reader) ([]Preset, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var presets []Preset
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var entries []presetJSON
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			presets = append(presets, Preset(e))
+		}
+	} else {
+		records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, rec := range records {
+			p, err := parsePreset(rec)
+			if err != nil {
+				return nil, fmt.Errorf("invalid preset on line %d: %w", i+1, err)
+			}
+			presets = append(presets, p)
+		}
+	}
+
+	if len(presets) == 0 {
+		return nil, errors.New("no preset defined")
+	}
+
+	for _, p := range presets {
+		if p.Name == "" {
+			return nil, errors.New("preset without name")
+		}
+		if p.Min >= p.Max {
+			return nil, fmt.Errorf("invalid range for preset %s: %.2f-%.2f", p.Name, p.Min, p.Max)
+		}
+	}
+
+	return presets, nil
+}
+
+// Warning is a suspicious part of a preset table: an overlap, a gap or an
+// inverted range, between Min and Max.
+type Warning struct {
+	Kind    string
+	Presets []string
+	Min     float64
+	Max     float64
+}
+
+// String implements fmt.Stringer for Warning.
+func (w Warning) String() string {
+	return fmt.Sprintf("[%s] %.2f-%.2f %s", w.Kind, w.Min, w.Max, strings.Join(w.Presets, " "))
+}
+
+// ValidatePresets reports the inverted ranges of a preset table, the ranges
+// overlapping each other and the gaps between them. The first preset is the
+// default one: it is expected to span the others and is left out of the
+// overlap and gap checks. Overlaps are resolved by PresetFromBPM in favor of
+// the narrowest range.
+func ValidatePresets(ps []Preset) []Warning {
+	var res []Warning
+
+	valid := make([]Preset, 0, len(ps))
+	for i, p := range ps {
+		switch {
+		case p.Min > p.Max:
+			res = append(res, Warning{"inverted", []string{p.Name}, p.Min, p.Max})
+		case i > 0:
+			valid = append(valid, p)
+		}
+	}
+
+	sort.SliceStable(valid, func(i, j int) bool { return valid[i].Min < valid[j].Min })
+
+	for i, a := range valid {
+		for _, b := range valid[i+1:] {
+			if b.Min <= a.Max {
+				res = append(res, Warning{"overlap", []string{a.Name, b.Name}, b.Min, min(a.Max, b.Max)})
+			}
+		}
+	}
+
+	for i := 1; i < len(valid); i++ {
+		covered := slices.MaxFunc(valid[:i], func(a, b Preset) int { return cmp.Compare(a.Max, b.Max) })
+
+		// BPM values are matched with a precision of 0.01.
+		if math.Round((valid[i].Min-covered.Max)*100) > 1 {
+			res = append(res, Warning{"gap", []string{covered.Name, valid[i].Name}, covered.Max, valid[i].Min})
+		}
+	}
+
+	return res
+}
+
+func parsePreset(rec []string) (Preset, error) {
+	if len(rec) != 3 {
+		return Preset{}, errors.New("want name,min,max")
+	}
+
+	min, err := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+	if err != nil {
+		return Preset{}, err
+	}
+
+	max, err := strconv.ParseFloat(strings.TrimSpace(rec[2]), 64)
+	if err != nil {
+		return Preset{}, err
+	}
+
+	return Preset{strings.TrimSpace(rec[0]), min, max}, nil
+}
+
+// RegisterPreset adds a preset to the built-in table, after the existing ones.
+// Its name must be unique and its range non-empty. Playlists created before
+// the call keep the previous table. It is meant to be called from an init
+// function and is not safe for concurrent use.
+func RegisterPreset(p Preset) error {
+	switch _, err := PresetFromName(p.Name); {
+	case p.Name == "" || p.Name == Auto.Name:
+		return fmt.Errorf("invalid preset name: %q", p.Name)
+	case err == nil:
+		return fmt.Errorf("preset already registered: %s", p.Name)
+	case p.Min >= p.Max:
+		return fmt.Errorf("invalid range for preset %s: %.2f-%.2f", p.Name, p.Min, p.Max)
+	}
+
+	Presets = append(slices.Clip(Presets), p)
+
+	return nil
+}
+
+// Auto is a pseudo-preset to pass to Analyze when the genre is unknown. The
+// BPM is detected in the range of the default preset and the track is then
+// assigned the preset matching it.
+var Auto = Preset{Name: "auto"}
+
+// PresetFromBPM returns the Preset with the narrowest BPM range matching the
+// given value. Among ranges of the same width, the one whose center is the
+// closest to the value wins, then the first name in alphabetical order.
 func PresetFromBPM(bpm float64) (Preset, error) {
+	return presetFromBPM(Presets, bpm)
+}
+
+// PresetFromName returns list BPM range preset from its name.
+func PresetFromName(name string) (Preset, error) {
+	return presetFromName(Presets, name)
+}
+
+func presetFromBPM(presets []Preset, bpm float64) (Preset, error) {
 	var match Preset
 
 	rounded := math.Round(bpm*100) / 100
-	for _, p := range Presets {
+	for _, p := range presets {
 		// Skip non-matching ranges.
 		if p.Min > rounded || rounded > p.Max {
 			continue
@@ -102,35 +372,83 @@ func PresetFromBPM(bpm float64) (Preset, error) {
 			continue
 		}
 
-		// Replace the match by the narrowest encountered range.
-		if p.Max-p.Min < match.Max-match.Min {
+		if narrower(p, match, rounded) {
 			match = p
-			continue
 		}
 	}
 
 	if match.Name == "" {
-		return Presets[0], fmt.Errorf("unknown BPM range for value: %.2f", bpm)
+		return presets[0], fmt.Errorf("unknown BPM range for value: %.2f", bpm)
 	}
 
 	return match, nil
 }
 
-// PresetFromName returns list BPM range preset from its name.
-func PresetFromName(name string) (Preset, error) {
-	for _, p := range Presets {
+// narrower reports whether a matching preset should be preferred over another
+// one for the given BPM. Values are compared with a precision of 0.01.
+func narrower(a, b Preset, bpm float64) bool {
+	cents := func(v float64) float64 { return math.Round(v * 100) }
+
+	if wa, wb := cents(a.Max-a.Min), cents(b.Max-b.Min); wa != wb {
+		return wa < wb
+	}
+
+	if da, db := cents(math.Abs((a.Min+a.Max)/2-bpm)), cents(math.Abs((b.Min+b.Max)/2-bpm)); da != db {
+		return da < db
+	}
+
+	return a.Name < b.Name
+}
+
+func presetFromName(presets []Preset, name string) (Preset, error) {
+	for _, p := range presets {
 		if p.Name == name {
 			return p, nil
 		}
 	}
-	return Presets[0], fmt.Errorf("unknown preset: %s", name)
+	return presets[0], fmt.Errorf("unknown preset: %s", name)
 }
 
 // Playlist is a DJ playlist.
 type Playlist struct {
 	path      string
+	store     Store
+	backups   int
+	unlocked  bool
+	encoding  StoreFormat
 	pipelines [4]Pipeline
 	scanner   BPMScanner
+	keys      KeyScanner
+	windows   int
+	formats   map[string]Pipeline
+	format    string
+	prober    CodecProber
+	tagger    TagsProber
+	dedup     bool
+	warnDups  bool
+	overwrite OverwritePolicy
+	sidecars  bool
+	precision int
+	folding   bool
+	presets   []Preset
+	quality   QualityScanner
+	loudness  LoudnessScanner
+	montage   Montage
+	sheets    bool
+	timeout   time.Duration
+	progress  func(done, total int, t Track)
+	failFast  bool
+	workers   int
+	repeats   int
+	rate      int
+	outDir    string
+	rebuild   bool
+	layout    Layout
+	deadline  time.Duration
+	retries   int
+	backoff   time.Duration
+	base      string
+	logger    *slog.Logger
 }
 
 // Pipeline is an external Unix pipeline.
@@ -148,7 +466,7 @@ func (f PipelineFunc) Run(ctx context.Context, in io.Reader, out, err io.Writer)
 
 // New returns a new Playlist.
 func New(opts ...Option) *Playlist {
-	list := new(Playlist)
+	list := &Playlist{precision: 2, presets: Presets, timeout: time.Minute, rate: rate, layout: DefaultLayout, logger: slog.New(discard{})}
 	for _, opt := range opts {
 		opt(list)
 	}
@@ -158,13 +476,157 @@ func New(opts ...Option) *Playlist {
 // Option is an option of the BPM analyzer.
 type Option func(*Playlist)
 
-// WithRepository configures the repository used to persist data.
+// WithLogger configures the logger receiving the events of the playlist:
+// analyzed tracks, skipped files, progress of the batches... By default, they
+// are discarded.
+func WithLogger(l *slog.Logger) Option {
+	return func(list *Playlist) {
+		list.logger = l
+	}
+}
+
+// discard is a slog.Handler dropping all records.
+type discard struct{}
+
+func (discard) Enabled(context.Context, slog.Level) bool  { return false }
+func (discard) Handle(context.Context, slog.Record) error { return nil }
+func (d discard) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discard) WithGroup(string) slog.Handler           { return d }
+
+// WithRepository configures the repository used to persist data as a JSON
+// file at the given path.
 func WithRepository(path string) Option {
 	return func(list *Playlist) {
 		list.path = path
 	}
 }
 
+// WithStore configures an alternative persistence backend. It takes
+// precedence over WithRepository.
+func WithStore(s Store) Option {
+	return func(list *Playlist) {
+		list.store = s
+	}
+}
+
+// Store persists the tracks of a playlist.
+type Store interface {
+	// Update loads the tracks, passes them to f and saves the returned ones.
+	// Concurrent updates must not interleave. Nothing is saved if f fails.
+	Update(f func([]Track) ([]Track, error)) error
+}
+
+// JSONFile is the default Store: a JSON file, unless configured otherwise,
+// protected by an exclusive advisory lock during updates. The path "-" reads
+// the tracks from the standard input: updates changing them then fail.
+type JSONFile struct {
+	Path     string
+	Backups  int          // Number of rotating backups kept before each update.
+	Unlocked bool         // Disables locking, see WithLocking.
+	Format   StoreFormat  // Encoding of the file, JSON by default.
+	Logger   *slog.Logger // Receives the lock fallbacks and restores, if set.
+}
+
+// logger returns the configured logger or one discarding the events.
+func (s JSONFile) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.New(discard{})
+	}
+	return s.Logger
+}
+
+// Update implements Store for JSONFile.
+func (s JSONFile) Update(f func([]Track) ([]Track, error)) error {
+	return withJSONFile(s, f)
+}
+
+// Restore replaces a corrupted file with its most recent valid backup.
+func (s JSONFile) Restore() error {
+	return restore[[]Track](s)
+}
+
+// StoreFormat is the encoding of the repository file.
+type StoreFormat int
+
+const (
+	// JSON is human-readable and editable by hand.
+	JSON StoreFormat = iota
+	// Gob is a compact binary encoding, faster to load and save for large
+	// collections.
+	Gob
+)
+
+// StoreFormatFromName returns the store format with the given name.
+func StoreFormatFromName(name string) (StoreFormat, error) {
+	switch strings.ToLower(name) {
+	case "json":
+		return JSON, nil
+	case "gob":
+		return Gob, nil
+	default:
+		return JSON, fmt.Errorf("unknown store format: %q", name)
+	}
+}
+
+// encode writes v to w in the store format.
+func (f StoreFormat) encode(w io.Writer, v any) error {
+	if f == Gob {
+		return gob.NewEncoder(w).Encode(v)
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+// decode reads v from r in the store format.
+func (f StoreFormat) decode(r io.Reader, v any) error {
+	if f == Gob {
+		return gob.NewDecoder(r).Decode(v)
+	}
+	return json.NewDecoder(r).Decode(v)
+}
+
+// WithStoreFormat sets the encoding of the repository file. Switching format
+// doesn't convert an existing file.
+func WithStoreFormat(f StoreFormat) Option {
+	return func(list *Playlist) {
+		list.encoding = f
+	}
+}
+
+// WithLocking enables or disables the locking of the JSON repository during
+// updates. It is enabled by default and should only be disabled on file
+// systems where no lock works at all: concurrent updates then overwrite
+// each other and the last one wins.
+func WithLocking(enabled bool) Option {
+	return func(list *Playlist) {
+		list.unlocked = !enabled
+	}
+}
+
+// WithBackups configures the JSON repository to keep n rotating backups of the
+// file, the most recent one being written before each update.
+func WithBackups(n int) Option {
+	return func(list *Playlist) {
+		list.backups = n
+	}
+}
+
+// Restore replaces a corrupted repository with its most recent valid backup.
+func (list *Playlist) Restore() error {
+	r, ok := list.repository().(interface{ Restore() error })
+	if !ok {
+		return errors.New("the repository does not support backups")
+	}
+	return r.Restore()
+}
+
+// repository returns the configured store.
+func (list *Playlist) repository() Store {
+	if list.store != nil {
+		return list.store
+	}
+	return JSONFile{Path: list.path, Backups: list.backups, Unlocked: list.unlocked, Format: list.encoding, Logger: list.logger}
+}
+
 // A codec is a way of transcoding the signal.
 type codec int
 
@@ -182,446 +644,3534 @@ func WithPipeline(c codec, p Pipeline) Option {
 	}
 }
 
-// BPMScanner scans raw f32le data for BPM given a range.
-type BPMScanner interface {
-	Scan(r io.Reader, min, max float64) (float64, error)
+// WithFormat registers a convert pipeline for the given output format (file
+// extension without the dot). Tracks overriding the output format are
+// converted with it instead of the Convert pipeline.
+func WithFormat(format string, p Pipeline) Option {
+	return func(list *Playlist) {
+		if list.formats == nil {
+			list.formats = make(map[string]Pipeline)
+		}
+		list.formats[format] = p
+	}
 }
 
-// BPMScanFunc is a function implementation of BPMScanner.
-type BPMScanFunc func(r io.Reader, min, max float64) (float64, error)
+// WithConvertFormat configures the default output format of Compile, replacing
+// WAV. The format must be registered with WithFormat. Tracks overriding their
+// output format are not affected.
+func WithConvertFormat(format string) Option {
+	return func(list *Playlist) {
+		list.format = format
+	}
+}
 
-// Scan implements BPMScanner for BPMScanFunc.
-func (f BPMScanFunc) Scan(r io.Reader, min, max float64) (float64, error) {
-	return f(r, min, max)
+// WithDeduplication configures Compile to convert tracks sharing the same
+// audio content only once. Duplicates are hardlinked to the first compiled
+// track so identical audio isn't stored twice on the target drive.
+func WithDeduplication() Option {
+	return func(list *Playlist) {
+		list.dedup = true
+	}
 }
 
-// WithBPMScanFunc configures the BPM scanner.
-func WithBPMScanFunc(f func(r io.Reader, min, max float64) (float64, error)) Option {
+// OverwritePolicy tells Compile what to do when a destination file exists.
+type OverwritePolicy int
+
+const (
+	// FailExisting aborts the compilation. This is the default.
+	FailExisting OverwritePolicy = iota
+	// SkipExisting keeps the existing file, allowing to resume a compilation.
+	SkipExisting
+	// OverwriteExisting replaces the existing file.
+	OverwriteExisting
+)
+
+// WithOverwritePolicy configures how Compile handles existing destinations.
+func WithOverwritePolicy(policy OverwritePolicy) Option {
 	return func(list *Playlist) {
-		list.scanner = BPMScanFunc(f)
+		list.overwrite = policy
 	}
 }
 
-// List pretty-prints the current playlist.
-func (list *Playlist) List(out io.Writer) error {
-	return withJSONFile(list.path, func(tracks []Track) ([]Track, error) {
-		for _, t := range tracks {
-			if _, err := fmt.Fprintln(out, t); err != nil {
-				return nil, err
-			}
-		}
-		return tracks, nil
-	})
+// WithOutputDir sets the name of the directory created by Compile in its
+// destination. A name containing "*" is a pattern for a new directory with a
+// random name, as with os.MkdirTemp. By default, the directory is named after
+// the time of the compilation. Existing files are handled according to the
+// overwrite policy.
+func WithOutputDir(name string) Option {
+	return func(list *Playlist) {
+		list.outDir = name
+	}
 }
 
-// Files prints all the absolute file paths, one per line.
-func (list *Playlist) Files(out io.Writer) error {
-	return withJSONFile(list.path, func(tracks []Track) ([]Track, error) {
-		for _, t := range tracks {
-			if _, err := fmt.Fprintln(out, t.Path); err != nil {
-				return nil, err
-			}
-		}
-		return tracks, nil
-	})
+// Layout returns the paths of the audio file, waveform and spectrogram
+// compiled from a track. They are relative to the directory created by
+// Compile and have no extension.
+type Layout func(Track) (audio, wave, spec string)
+
+// DefaultLayout puts the files in audio, waveforms and spectrograms
+// directories, then in a directory per preset, named after the BPM and the
+// tags of the track or its original name: audio/house/124 - Artist - Title.
+func DefaultLayout(t Track) (string, string, string) {
+	name := rename(t)
+	return filepath.Join("audio", name), filepath.Join("waveforms", name), filepath.Join("spectrograms", name)
 }
 
-// Prune remove files that are not a their reported location anymore.
-// It is based on the status() function, so this could have more criteria in
-// the near future.
-func (list *Playlist) Prune() error {
-	return withJSONFile(list.path, func(old []Track) ([]Track, error) {
-		tracks := make([]Track, 0)
-		for i := range old {
-			if status(old[i]) != fail {
-				tracks = append(tracks, old[i])
-			} else {
-				log.Println(old[i])
-			}
-		}
-		return tracks, nil
-	})
+// WithLayout configures where Compile writes the files of each track.
+// Returned paths must be local to the output directory, as with
+// filepath.IsLocal. By default, DefaultLayout is used.
+func WithLayout(f func(Track) (audio, wave, spec string)) Option {
+	return func(list *Playlist) {
+		list.layout = f
+	}
 }
 
-// Analyze adds a track to the playlist and computes its BPM.
-func (list *Playlist) Analyze(ctx context.Context, path string, preset Preset) error {
-	return withJSONFile(list.path, func(tracks []Track) ([]Track, error) {
-		abs, err := filepath.Abs(filepath.Clean(path))
-		if err != nil {
-			return nil, err
+// WithBaseDir stores the paths of the tracks in the given directory relative
+// to it, so that the repository can be moved along with the audio files.
+// Relative paths are resolved against it when read. Paths outside of it, and
+// all paths by default, are stored absolute.
+func WithBaseDir(root string) Option {
+	return func(list *Playlist) {
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
 		}
+		list.base = filepath.Clean(root)
+	}
+}
 
-		track, err := track(ctx, abs, preset, list.pipelines[Analyze], list.scanner)
-		if err != nil {
-			return nil, err
-		}
+// WithRebuild makes Compile convert all tracks again. By default, the tracks
+// recorded in the manifest of the output directory are skipped if their audio
+// content didn't change and their files still exist.
+func WithRebuild() Option {
+	return func(list *Playlist) {
+		list.rebuild = true
+	}
+}
 
-		var found bool
-		for i := range tracks {
-			if tracks[i].Hash == track.Hash {
-				tracks[i] = track
-				found = true
-				break
-			}
-		}
+// Montage combines pictures, given by their paths, into a single one.
+type Montage interface {
+	Montage(ctx context.Context, paths []string, out, err io.Writer) error
+}
 
-		if !found {
-			tracks = append(tracks, track)
-		}
+// MontageFunc is a function implementation of Montage.
+type MontageFunc func(ctx context.Context, paths []string, out, err io.Writer) error
 
-		log.Println(track)
+// Montage implements Montage for MontageFunc.
+func (f MontageFunc) Montage(ctx context.Context, paths []string, out, err io.Writer) error {
+	return f(ctx, paths, out, err)
+}
 
-		order(tracks)
+// WithMontageFunc configures how contact sheets are made.
+func WithMontageFunc(f func(ctx context.Context, paths []string, out, err io.Writer) error) Option {
+	return func(list *Playlist) {
+		list.montage = MontageFunc(f)
+	}
+}
 
-		return tracks, nil
-	})
+// WithContactSheet makes Compile combine the waveforms of each directory, that
+// is of each preset with DefaultLayout, into a contactsheet.png picture next to
+// them once all tracks are compiled. It requires WithMontageFunc.
+func WithContactSheet() Option {
+	return func(list *Playlist) {
+		list.sheets = true
+	}
 }
 
-// Refresh re-analyzes all tracks in the playlist.
-func (list *Playlist) Refresh(ctx context.Context) error {
-	return withJSONFile(list.path, func(old []Track) ([]Track, error) {
-		// Each job will spawn two goroutines (hash and BPM analysis).
-		var n = runtime.NumCPU() / 2
+// WithConcurrency configures the number of tracks processed concurrently by
+// Refresh, Compile and AnalyzeDir, at least 1. By default, it depends on the
+// number of CPUs.
+func WithConcurrency(n int) Option {
+	return func(list *Playlist) {
+		list.workers = max(1, n)
+	}
+}
 
-		log.Println("[workers]", n)
+// WithFailFast configures Refresh and Compile to stop at the first track
+// error without saving anything. By default, errors are collected and
+// reported at the end while the successful tracks are still processed.
+func WithFailFast() Option {
+	return func(list *Playlist) {
+		list.failFast = true
+	}
+}
 
-		out, tracks, wg := make(chan Track, n), make([]Track, 0), new(sync.WaitGroup)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for t := range out {
-				tracks = append(tracks, t)
-			}
-		}()
+// WithProgress configures Refresh and Compile to call f each time a track is
+// processed, whether it succeeded or not. Calls are serialized.
+func WithProgress(f func(done, total int, t Track)) Option {
+	return func(list *Playlist) {
+		list.progress = f
+	}
+}
 
-		do := func(t Track) error {
-			// Recompute the appropriate preset from the last known BPM. It allows to
-			// change and move preset layout around freely.
-			if t.Preset.Name == "" {
-				t.Preset, _ = PresetFromBPM(t.BPM)
+// WithDuplicateWarnings configures Analyze to keep the existing entry and log a
+// warning when the analyzed file has the same audio content as a track stored
+// under a different path, instead of overwriting the entry.
+func WithDuplicateWarnings() Option {
+	return func(list *Playlist) {
+		list.warnDups = true
+	}
+}
+
+// WithSidecars configures the analysis to also write the track metadata in a
+// JSON file next to each audio file, so it travels with the file. Refresh
+// reuses up-to-date sidecars instead of analyzing the track again.
+func WithSidecars() Option {
+	return func(list *Playlist) {
+		list.sidecars = true
+	}
+}
+
+// WithPresets configures the playlist to use a custom preset table instead of
+// the built-in one. It must have at least one element being the default preset
+// at index 0.
+func WithPresets(presets []Preset) Option {
+	return func(list *Playlist) {
+		list.presets = presets
+	}
+}
+
+// Presets returns the preset table used by the playlist.
+func (list *Playlist) Presets() []Preset {
+	return list.presets
+}
+
+// PresetFromBPM is like PresetFromBPM using the preset table of the playlist.
+func (list *Playlist) PresetFromBPM(bpm float64) (Preset, error) {
+	return presetFromBPM(list.presets, bpm)
+}
+
+// PresetFromName is like PresetFromName using the preset table of the playlist.
+func (list *Playlist) PresetFromName(name string) (Preset, error) {
+	return presetFromName(list.presets, name)
+}
+
+// classify returns the preset of the playlist matching a BPM value, or the
+// default preset if none does.
+func (list *Playlist) classify(bpm float64) Preset {
+	p, err := list.PresetFromBPM(bpm)
+	if err != nil {
+		return list.presets[0]
+	}
+	return p
+}
+
+// WithPrecision configures the number of decimals of the stored BPM values.
+// It defaults to 2, which is the precision used to classify tracks in presets.
+// A negative value disables rounding.
+func WithPrecision(n int) Option {
+	return func(list *Playlist) {
+		list.precision = n
+	}
+}
+
+// WithTempoFolding configures the analysis to double or halve a detected BPM
+// outside of the requested preset range when this brings it back in range.
+// This fixes tracks detected at half or double their actual tempo.
+func WithTempoFolding() Option {
+	return func(list *Playlist) {
+		list.folding = true
+	}
+}
+
+// WithTimeout configures the maximum duration of each pipeline invocation.
+// It defaults to one minute. A zero value means no deadline other than the
+// one of the parent context.
+func WithTimeout(d time.Duration) Option {
+	return func(list *Playlist) {
+		list.timeout = d
+	}
+}
+
+// WithDeadline caps the total duration of Refresh and Compile, on top of the
+// timeout of each pipeline. When it expires, the tracks processed so far are
+// kept as on cancellation. A zero value means no deadline.
+func WithDeadline(d time.Duration) Option {
+	return func(list *Playlist) {
+		list.deadline = d
+	}
+}
+
+// WithRetries makes failed pipelines run again up to n times, waiting the
+// backoff before the first retry and twice as long before each next one.
+// Only pipelines whose input and output can be rewound, such as files, are
+// retried, and never once the context is done. It defaults to no retry.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(list *Playlist) {
+		list.retries, list.backoff = n, backoff
+	}
+}
+
+// bounded returns the context of a whole operation given the deadline.
+func (list *Playlist) bounded(ctx context.Context) (context.Context, context.CancelFunc) {
+	if list.deadline <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, list.deadline)
+}
+
+// pipeline returns the configured pipeline for the given codec.
+func (list *Playlist) pipeline(c codec) Pipeline {
+	return list.guarded(list.pipelines[c])
+}
+
+// guarded wraps a pipeline with the configured timeout and retries.
+func (list *Playlist) guarded(p Pipeline) Pipeline {
+	return list.retried(list.timed(p))
+}
+
+// timed wraps a pipeline with the configured timeout.
+func (list *Playlist) timed(p Pipeline) Pipeline {
+	if list.timeout == 0 {
+		return p
+	}
+
+	d := list.timeout
+
+	return PipelineFunc(func(parent context.Context, in io.Reader, out, err io.Writer) error {
+		ctx, cancel := context.WithTimeout(parent, d)
+		defer cancel()
+		return p.Run(ctx, in, out, err)
+	})
+}
+
+// retried wraps a pipeline with the configured retries.
+func (list *Playlist) retried(p Pipeline) Pipeline {
+	if list.retries <= 0 {
+		return p
+	}
+
+	n, backoff := list.retries, list.backoff
+
+	return PipelineFunc(func(ctx context.Context, in io.Reader, out, stderr io.Writer) error {
+		for i := 0; ; i++ {
+			err := p.Run(ctx, in, out, stderr)
+			if err == nil || i == n || ctx.Err() != nil || rewind(in, out) != nil {
+				return err
 			}
 
-			t, err := track(ctx, t.Path, t.Preset, list.pipelines[Analyze], list.scanner)
-			if err != nil {
+			list.logger.Warn("retry", "attempt", i+1, "err", err)
+
+			select {
+			case <-ctx.Done():
 				return err
+			case <-time.After(backoff << i):
+			}
+		}
+	})
+}
+
+// rewind prepares the input and output of a pipeline for another run. It
+// fails if either cannot be rewound.
+func rewind(in io.Reader, out io.Writer) error {
+	if in != nil {
+		s, ok := in.(io.Seeker)
+		if !ok {
+			return errors.New("input cannot be rewound")
+		}
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	f, ok := out.(interface {
+		io.Seeker
+		Truncate(int64) error
+	})
+	if !ok {
+		return errors.New("output cannot be rewound")
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// BPMScanner scans raw f32le data for BPM given a range.
+type BPMScanner interface {
+	Scan(r io.Reader, min, max float64) (float64, error)
+}
+
+// BPMScanFunc is a function implementation of BPMScanner.
+type BPMScanFunc func(r io.Reader, min, max float64) (float64, error)
+
+// Scan implements BPMScanner for BPMScanFunc.
+func (f BPMScanFunc) Scan(r io.Reader, min, max float64) (float64, error) {
+	return f(r, min, max)
+}
+
+// WithBPMScanFunc configures the BPM scanner.
+func WithBPMScanFunc(f func(r io.Reader, min, max float64) (float64, error)) Option {
+	return func(list *Playlist) {
+		list.scanner = BPMScanFunc(f)
+	}
+}
+
+// BPMContextScanner is a BPMScanner which can be interrupted. The analysis
+// passes its context to scanners implementing it.
+type BPMContextScanner interface {
+	BPMScanner
+	ScanContext(ctx context.Context, r io.Reader, min, max float64) (float64, error)
+}
+
+// BPMScanContextFunc is a function implementation of BPMContextScanner.
+type BPMScanContextFunc func(ctx context.Context, r io.Reader, min, max float64) (float64, error)
+
+// Scan implements BPMScanner for BPMScanContextFunc.
+func (f BPMScanContextFunc) Scan(r io.Reader, min, max float64) (float64, error) {
+	return f(context.Background(), r, min, max)
+}
+
+// ScanContext implements BPMContextScanner for BPMScanContextFunc.
+func (f BPMScanContextFunc) ScanContext(ctx context.Context, r io.Reader, min, max float64) (float64, error) {
+	return f(ctx, r, min, max)
+}
+
+// WithBPMScanContextFunc configures a BPM scanner stopping when the analysis
+// is cancelled.
+func WithBPMScanContextFunc(f func(ctx context.Context, r io.Reader, min, max float64) (float64, error)) Option {
+	return func(list *Playlist) {
+		list.scanner = BPMScanContextFunc(f)
+	}
+}
+
+// scanBPM runs a BPM scanner, with the context if it supports it.
+func scanBPM(ctx context.Context, s BPMScanner, r io.Reader, min, max float64) (float64, error) {
+	if c, ok := s.(BPMContextScanner); ok {
+		return c.ScanContext(ctx, r, min, max)
+	}
+	return s.Scan(r, min, max)
+}
+
+// KeyScanner scans raw f32le data for the musical key.
+type KeyScanner interface {
+	Key(r io.Reader) (string, error)
+}
+
+// KeyScanFunc is a function implementation of KeyScanner.
+type KeyScanFunc func(r io.Reader) (string, error)
+
+// Key implements KeyScanner for KeyScanFunc.
+func (f KeyScanFunc) Key(r io.Reader) (string, error) {
+	return f(r)
+}
+
+// WithKeyScanFunc configures the key scanner. The decoded signal is shared
+// with the BPM scanner. Tracks whose key is not found get an empty one.
+func WithKeyScanFunc(f func(r io.Reader) (string, error)) Option {
+	return func(list *Playlist) {
+		list.keys = KeyScanFunc(f)
+	}
+}
+
+// WithMultiWindow configures the BPM analysis to scan n non-overlapping windows
+// of each track separately. Windows too far from the median are rejected and
+// the remaining values are averaged. This limits the influence of a single
+// anomalous section (breakdown, tempo change...) on the result.
+func WithMultiWindow(n int) Option {
+	return func(list *Playlist) {
+		list.windows = n
+	}
+}
+
+// WithScanRepeats configures the BPM analysis to scan each track n times and
+// keep the median value. The scan being stochastic, this stabilizes the result
+// of successive refreshes at the cost of n times the CPU time. The default is
+// a single scan.
+func WithScanRepeats(n int) Option {
+	return func(list *Playlist) {
+		list.repeats = n
+	}
+}
+
+// WithSampleRate sets the sample rate of the signal produced by the analyze
+// pipeline, 44100 by default. The analyze pipeline and the BPM and key
+// scanners not configured yet are set to the ffmpeg(1) pipeline and the
+// scanners of the bpm and key packages working at that rate. Options given
+// after it override them.
+func WithSampleRate(n int) Option {
+	return func(list *Playlist) {
+		if n <= 0 {
+			return
+		}
+
+		list.rate = n
+
+		if list.pipelines[Analyze] == nil {
+			if f, err := ffmpeg.F32LEOpts(n); err == nil {
+				list.pipelines[Analyze] = PipelineFunc(f)
+			}
+		}
+		if list.scanner == nil {
+			list.scanner = BPMScanContextFunc(bpm.Config{Rate: n}.ScanContext)
+		}
+		if list.keys == nil {
+			list.keys = KeyScanFunc(key.Config{Rate: n}.Scan)
+		}
+	}
+}
+
+// bpm returns the effective BPM scanner.
+func (list *Playlist) bpm() BPMScanner {
+	s := list.scanner
+	if list.windows > 1 {
+		s = windowed{list.windows, s, list.logger}
+	}
+	if list.repeats > 1 {
+		s = repeated{list.repeats, s, list.logger}
+	}
+	return s
+}
+
+// repeated is a BPMScanner scanning the same data multiple times.
+type repeated struct {
+	n   int
+	s   BPMScanner
+	log *slog.Logger
+}
+
+// Scan implements BPMScanner for repeated.
+func (r repeated) Scan(in io.Reader, min, max float64) (float64, error) {
+	return r.ScanContext(context.Background(), in, min, max)
+}
+
+// ScanContext implements BPMContextScanner for repeated. The signal is spooled
+// to a temporary file so that a long track is never held in memory.
+func (r repeated) ScanContext(ctx context.Context, in io.Reader, min, max float64) (float64, error) {
+	tmp, size, err := spool(in)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	defer tmp.Close()
+
+	values := make([]float64, r.n)
+	for i := range values {
+		values[i], err = scanBPM(ctx, r.s, io.NewSectionReader(tmp, 0, size), min, max)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	r.log.Debug("repeats", "bpm", values)
+
+	return median(values), nil
+}
+
+// spool copies the signal to a temporary file and returns it with its size.
+// The caller removes the file.
+func spool(in io.Reader) (*os.File, int64, error) {
+	tmp, err := os.CreateTemp("", "mkcdj-*.f32")
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not create temporary file: %w", err)
+	}
+
+	size, err := io.Copy(tmp, in)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name()) //nolint:errcheck
+		return nil, 0, err
+	}
+
+	return tmp, size, nil
+}
+
+// windowed is a BPMScanner splitting the data into multiple windows.
+type windowed struct {
+	n   int
+	s   BPMScanner
+	log *slog.Logger
+}
+
+// Maximum relative deviation from the median for a window to be kept.
+const outlier = 0.05
+
+// Scan implements BPMScanner for windowed.
+func (w windowed) Scan(r io.Reader, min, max float64) (float64, error) {
+	return w.ScanContext(context.Background(), r, min, max)
+}
+
+// ScanContext implements BPMContextScanner for windowed. The signal is spooled
+// to a temporary file, each window being read from it in turn.
+func (w windowed) ScanContext(ctx context.Context, r io.Reader, min, max float64) (float64, error) {
+	tmp, total, err := spool(r)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	defer tmp.Close()
+
+	// Windows must be aligned on 32 bits samples.
+	size := total / int64(w.n) &^ 3
+	if size == 0 {
+		return scanBPM(ctx, w.s, io.NewSectionReader(tmp, 0, total), min, max)
+	}
+
+	values := make([]float64, w.n)
+	for i := range values {
+		values[i], err = scanBPM(ctx, w.s, io.NewSectionReader(tmp, int64(i)*size, size), min, max)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	w.log.Debug("windows", "bpm", values)
+
+	m := median(values)
+
+	var sum, n float64
+	for _, v := range values {
+		if math.Abs(v-m) > m*outlier {
+			w.log.Debug("outlier", "bpm", v)
+			continue
+		}
+		sum, n = sum+v, n+1
+	}
+
+	if n == 0 {
+		return m, nil
+	}
+
+	return sum / n, nil
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	return sorted[n/2]
+}
+
+// CodecProber returns the name of the audio codec of a file.
+type CodecProber interface {
+	Probe(ctx context.Context, path string) (string, error)
+}
+
+// CodecProbeFunc is a function implementation of CodecProber.
+type CodecProbeFunc func(ctx context.Context, path string) (string, error)
+
+// Probe implements CodecProber for CodecProbeFunc.
+func (f CodecProbeFunc) Probe(ctx context.Context, path string) (string, error) {
+	return f(ctx, path)
+}
+
+// WithCodecProbeFunc configures the codec prober used to detect files whose
+// extension doesn't match their actual format.
+func WithCodecProbeFunc(f func(ctx context.Context, path string) (string, error)) Option {
+	return func(list *Playlist) {
+		list.prober = CodecProbeFunc(f)
+	}
+}
+
+// Tags are the metadata of an audio file.
+type Tags struct {
+	Artist string
+	Title  string
+}
+
+// TagsProber returns the tags of an audio file.
+type TagsProber interface {
+	Tags(ctx context.Context, path string) (Tags, error)
+}
+
+// TagsProbeFunc is a function implementation of TagsProber.
+type TagsProbeFunc func(ctx context.Context, path string) (Tags, error)
+
+// Tags implements TagsProber for TagsProbeFunc.
+func (f TagsProbeFunc) Tags(ctx context.Context, path string) (Tags, error) {
+	return f(ctx, path)
+}
+
+// WithTagsProbeFunc configures the prober reading the artist and title of the
+// tracks, used to name the compiled files.
+func WithTagsProbeFunc(f func(ctx context.Context, path string) (Tags, error)) Option {
+	return func(list *Playlist) {
+		list.tagger = TagsProbeFunc(f)
+	}
+}
+
+// QualityScanner returns the quality score of an audio file.
+type QualityScanner interface {
+	Quality(ctx context.Context, path string) (float64, error)
+}
+
+// QualityScanFunc is a function implementation of QualityScanner.
+type QualityScanFunc func(ctx context.Context, path string) (float64, error)
+
+// Quality implements QualityScanner for QualityScanFunc.
+func (f QualityScanFunc) Quality(ctx context.Context, path string) (float64, error) {
+	return f(ctx, path)
+}
+
+// WithQualityScanFunc configures the quality scanner. Without it, or if it
+// fails, tracks are not scored.
+func WithQualityScanFunc(f func(ctx context.Context, path string) (float64, error)) Option {
+	return func(list *Playlist) {
+		list.quality = QualityScanFunc(f)
+	}
+}
+
+// LoudnessScanner returns the integrated loudness of an audio file, in LUFS.
+type LoudnessScanner interface {
+	Loudness(ctx context.Context, path string) (float64, error)
+}
+
+// LoudnessScanFunc is a function implementation of LoudnessScanner.
+type LoudnessScanFunc func(ctx context.Context, path string) (float64, error)
+
+// Loudness implements LoudnessScanner for LoudnessScanFunc.
+func (f LoudnessScanFunc) Loudness(ctx context.Context, path string) (float64, error) {
+	return f(ctx, path)
+}
+
+// WithLoudnessScanFunc configures the loudness scanner. Without it, the
+// loudness of tracks is not measured.
+func WithLoudnessScanFunc(f func(ctx context.Context, path string) (float64, error)) Option {
+	return func(list *Playlist) {
+		list.loudness = LoudnessScanFunc(f)
+	}
+}
+
+// List pretty-prints the current playlist.
+func (list *Playlist) List(out io.Writer) error {
+	return list.update(func(tracks []Track) ([]Track, error) {
+		for _, t := range tracks {
+			if _, err := fmt.Fprintln(out, t); err != nil {
+				return nil, err
 			}
+		}
+		return tracks, nil
+	})
+}
+
+// ListStatus writes the tracks having one of the given statuses (good, warn
+// or fail) in human-readable form.
+func (list *Playlist) ListStatus(out io.Writer, statuses ...string) error {
+	for _, s := range statuses {
+		if s != good && s != warn && s != fail {
+			return fmt.Errorf("unknown status: %s", s)
+		}
+	}
+
+	return list.Find(out, func(t Track) bool {
+		return slices.Contains(statuses, status(t))
+	})
+}
+
+// ListJSON writes the current playlist as a JSON array, in the same shape as
+// the repository plus the computed status of each track. Tracks are encoded
+// one by one so the whole array is never buffered.
+func (list *Playlist) ListJSON(out io.Writer) error {
+	return list.update(func(tracks []Track) ([]Track, error) {
+		if _, err := io.WriteString(out, "["); err != nil {
+			return nil, err
+		}
+
+		for i := range tracks {
+			if i > 0 {
+				if _, err := io.WriteString(out, ","); err != nil {
+					return nil, err
+				}
+			}
+
+			data, err := json.Marshal(listed{&tracks[i], status(tracks[i])})
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err := out.Write(data); err != nil {
+				return nil, err
+			}
+		}
+
+		_, err := io.WriteString(out, "]\n")
+		return tracks, err
+	})
+}
+
+// ListNDJSON writes the current playlist as JSON Lines: one object per track,
+// in the same shape as the repository.
+func (list *Playlist) ListNDJSON(out io.Writer) error {
+	return list.view(func(tracks []Track) error {
+		enc := json.NewEncoder(out)
+		for i := range tracks {
+			if err := enc.Encode(&tracks[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// listed is the JSON form of a track in listings. The status is derived from
+// the file at read time, so it is never stored and ignored when decoding.
+type listed struct {
+	*Track
+	Status string `json:"status"`
+}
+
+// ExportM3U writes an extended M3U playlist of the tracks compiled in the
+// given directory, in playlist order. The directory is either the one created
+// by Compile or the top-level subdirectory holding the audio files, such as
+// audio with the default layout. Paths are relative to the directory and tracks missing
+// from it are skipped.
+func (list *Playlist) ExportM3U(out io.Writer, dir string) error {
+	return list.update(func(tracks []Track) ([]Track, error) {
+		sorted := append([]Track(nil), tracks...)
+		order(sorted)
+
+		if _, err := fmt.Fprintln(out, "#EXTM3U"); err != nil {
+			return nil, err
+		}
+
+		unique, err := names(sorted, list.extension, list.layout)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range sorted {
+			name, ok := compiledIn(dir, unique[t.Path].audio+list.extension(t))
+			if !ok {
+				list.logger.Warn("missing", "track", t)
+				continue
+			}
+
+			info := fmt.Sprintf("#EXTINF:-1,%s", filepath.Base(unique[t.Path].audio))
+
+			if _, err := fmt.Fprintf(out, "%s\n%s\n", info, filepath.ToSlash(name)); err != nil {
+				return nil, err
+			}
+		}
+
+		return tracks, nil
+	})
+}
+
+// compiledIn returns the path relative to dir of a file compiled at the given
+// path, relative to the output directory. The directory is either the output
+// directory or the top-level subdirectory holding the file.
+func compiledIn(dir, path string) (string, bool) {
+	candidates := []string{path}
+	if _, rest, ok := strings.Cut(filepath.ToSlash(path), "/"); ok {
+		candidates = append(candidates, filepath.FromSlash(rest))
+	}
+
+	for _, name := range candidates {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// Find pretty-prints the tracks matching the given predicate.
+func (list *Playlist) Find(out io.Writer, match func(Track) bool) error {
+	return list.update(func(tracks []Track) ([]Track, error) {
+		for _, t := range tracks {
+			if !match(t) {
+				continue
+			}
+			if _, err := fmt.Fprintln(out, t); err != nil {
+				return nil, err
+			}
+		}
+		return tracks, nil
+	})
+}
+
+// Filter is a set of constraints on tracks. Empty fields mean no constraint.
+type Filter struct {
+	Preset string  // Preset name.
+	Min    float64 // Inclusive lower BPM bound.
+	Max    float64 // Inclusive upper BPM bound.
+}
+
+// Match reports whether the track satisfies all constraints of the filter.
+func (f Filter) Match(t Track) bool {
+	switch {
+	case f.Preset != "" && t.Preset.Name != f.Preset:
+		return false
+	case f.Min != 0 && t.BPM < f.Min:
+		return false
+	case f.Max != 0 && t.BPM > f.Max:
+		return false
+	default:
+		return true
+	}
+}
+
+// validate returns an error if the filter refers to an unknown preset.
+func (list *Playlist) validate(f Filter) error {
+	if f.Preset == "" {
+		return nil
+	}
+	_, err := list.PresetFromName(f.Preset)
+	return err
+}
+
+// Search pretty-prints the tracks matching the given filter.
+func (list *Playlist) Search(out io.Writer, filter Filter) error {
+	if err := list.validate(filter); err != nil {
+		return err
+	}
+	return list.Find(out, filter.Match)
+}
+
+// Extract writes a standalone playlist containing the tracks matching the
+// given filter to out.
+func (list *Playlist) Extract(out io.Writer, filter Filter) error {
+	if err := list.validate(filter); err != nil {
+		return err
+	}
+
+	return list.update(func(tracks []Track) ([]Track, error) {
+		res := make([]Track, 0)
+		for _, t := range tracks {
+			if filter.Match(t) {
+				res = append(res, t)
+			}
+		}
+		return tracks, json.NewEncoder(out).Encode(res)
+	})
+}
+
+// csvHeader are the columns of ExportCSV.
+var csvHeader = []string{"path", "hash", "preset", "bpm", "duration", "quality"}
+
+// ExportCSV writes the playlist as CSV with a header row. The BPM is rounded
+// like in List, the duration is in seconds. Missing durations and quality
+// scores are left empty.
+func (list *Playlist) ExportCSV(out io.Writer) error {
+	return list.view(func(tracks []Track) error {
+		sorted := append([]Track(nil), tracks...)
+		order(sorted)
+
+		w := csv.NewWriter(out)
+
+		if err := w.Write(csvHeader); err != nil {
+			return err
+		}
+
+		for _, t := range sorted {
+			var duration, score string
+			if t.Duration > 0 {
+				duration = fmt.Sprintf("%.0f", t.Duration)
+			}
+			if scored(t) {
+				score = fmt.Sprintf("%.4f", t.Quality)
+			}
+
+			bpm := fmt.Sprintf("%.0f", math.Round(t.BPM))
+
+			if err := w.Write([]string{t.Path, t.Hash, t.Preset.Name, bpm, duration, score}); err != nil {
+				return err
+			}
+		}
+
+		w.Flush()
+
+		return w.Error()
+	})
+}
+
+// ImportCSV merges tracks read from CSV in the format of ExportCSV into the
+// playlist: entries with the same hash are updated, others are added. The BPM
+// of an existing entry is kept if it rounds to the imported value. Invalid
+// rows, such as rows with an unknown preset, are reported together once the
+// valid ones are imported.
+func (list *Playlist) ImportCSV(r io.Reader) error {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return err
+	}
+
+	if len(records) == 0 {
+		return errors.New("missing CSV header")
+	}
+
+	cols := make(map[string]int)
+	for i, name := range records[0] {
+		cols[strings.TrimSpace(name)] = i
+	}
+
+	for _, name := range csvHeader[:4] {
+		if _, ok := cols[name]; !ok {
+			return fmt.Errorf("missing CSV column: %s", name)
+		}
+	}
+
+	// field returns a column of a record, empty if absent.
+	field := func(rec []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+
+	var errs []error
+	imported := make([]Track, 0, len(records)-1)
+
+	for i, rec := range records[1:] {
+		t, err := list.parseTrack(func(name string) string { return field(rec, name) })
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", i+2, err))
+			continue
+		}
+		imported = append(imported, t)
+	}
+
+	err = list.update(func(tracks []Track) ([]Track, error) {
+		for _, t := range imported {
+			if i, err := lookup(tracks, t.Hash); err == nil {
+				t = overlay(tracks[i], t)
+			}
+			tracks = merge(tracks, t)
+		}
+
+		order(tracks)
+
+		return tracks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(errs...)
+}
+
+// parseTrack returns the track described by the fields of a CSV record.
+func (list *Playlist) parseTrack(field func(string) string) (Track, error) {
+	t := Track{Path: field("path"), Hash: field("hash")}
+
+	if t.Path == "" || t.Hash == "" {
+		return Track{}, errors.New("missing path or hash")
+	}
+
+	var err error
+
+	if t.Preset, err = list.PresetFromName(field("preset")); err != nil {
+		return Track{}, err
+	}
+
+	if t.BPM, err = strconv.ParseFloat(field("bpm"), 64); err != nil {
+		return Track{}, fmt.Errorf("invalid BPM: %w", err)
+	}
+
+	for _, f := range [...]struct {
+		name string
+		dst  *float64
+	}{{"duration", &t.Duration}, {"quality", &t.Quality}} {
+		if v := field(f.name); v != "" {
+			if *f.dst, err = strconv.ParseFloat(v, 64); err != nil {
+				return Track{}, fmt.Errorf("invalid %s: %w", f.name, err)
+			}
+		}
+	}
+
+	t.Scored = field("quality") != ""
+
+	return t, nil
+}
+
+// overlay applies the imported fields of a track to its existing entry.
+// Fields missing from the import and the precision lost by the export are
+// kept from the existing entry.
+func overlay(old, t Track) Track {
+	res := old
+	res.Path, res.Preset = t.Path, t.Preset
+
+	if math.Round(old.BPM) != t.BPM {
+		res.BPM = t.BPM
+	}
+	if math.Round(old.Duration) != t.Duration && t.Duration != 0 {
+		res.Duration = t.Duration
+	}
+	if scored(t) {
+		res.Quality, res.Scored = t.Quality, true
+	}
+
+	return res
+}
+
+// Files prints all the absolute file paths, each one followed by the given
+// delimiter: '\n' for one per line, 0 for xargs -0.
+func (list *Playlist) Files(out io.Writer, delim byte) error {
+	return list.update(func(tracks []Track) ([]Track, error) {
+		for _, t := range tracks {
+			if _, err := fmt.Fprintf(out, "%s%c", t.Path, delim); err != nil {
+				return nil, err
+			}
+		}
+		return tracks, nil
+	})
+}
+
+// Names prints the path of the audio file Compile would write for each track,
+// relative to the output directory, in the order of compilation:
+// "path -> name". Collisions are resolved as by Compile.
+func (list *Playlist) Names(out io.Writer) error {
+	return list.view(func(tracks []Track) error {
+		sorted := append([]Track(nil), tracks...)
+		order(sorted)
+
+		unique, err := names(sorted, list.extension, list.layout)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range sorted {
+			name := unique[t.Path].audio + list.extension(t)
+			if _, err := fmt.Fprintf(out, "%s -> %s\n", t.Path, name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Stats are the aggregates of a playlist.
+type Stats struct {
+	Tracks  int
+	Failed  int            // Tracks with the fail status.
+	Presets map[string]int // Number of tracks per preset name.
+	MinBPM  float64
+	AvgBPM  float64
+	MaxBPM  float64
+}
+
+// String implements fmt.Stringer for Stats. Presets are sorted by name so
+// that the output is stable.
+func (s Stats) String() string {
+	b := new(strings.Builder)
+
+	fmt.Fprintf(b, "tracks: %d\n", s.Tracks)
+	fmt.Fprintf(b, "failed: %d\n", s.Failed)
+	fmt.Fprintf(b, "bpm: %.2f/%.2f/%.2f\n", s.MinBPM, s.AvgBPM, s.MaxBPM)
+
+	names := make([]string, 0, len(s.Presets))
+	for name := range s.Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(b, "preset %s: %d\n", name, s.Presets[name])
+	}
+
+	return b.String()
+}
+
+// Stats returns the aggregates of the playlist.
+func (list *Playlist) Stats() (Stats, error) {
+	s := Stats{Presets: make(map[string]int)}
+
+	err := list.update(func(tracks []Track) ([]Track, error) {
+		var sum float64
+
+		for i, t := range tracks {
+			if i == 0 || t.BPM < s.MinBPM {
+				s.MinBPM = t.BPM
+			}
+			if i == 0 || t.BPM > s.MaxBPM {
+				s.MaxBPM = t.BPM
+			}
+			if status(t) == fail {
+				s.Failed++
+			}
+			s.Presets[t.Preset.Name]++
+			sum += t.BPM
+		}
+
+		if s.Tracks = len(tracks); s.Tracks > 0 {
+			s.AvgBPM = sum / float64(s.Tracks)
+		}
+
+		return tracks, nil
+	})
+
+	return s, err
+}
+
+// Duplicates prints the groups of tracks sharing the same audio content under
+// different paths: the hash followed by one indented path per line.
+func (list *Playlist) Duplicates(out io.Writer) error {
+	return list.update(func(tracks []Track) ([]Track, error) {
+		groups, hashes := make(map[string][]string), make([]string, 0)
+
+		for _, t := range tracks {
+			if _, ok := groups[t.Hash]; !ok {
+				hashes = append(hashes, t.Hash)
+			}
+			groups[t.Hash] = append(groups[t.Hash], t.Path)
+		}
+
+		for _, h := range hashes {
+			if len(groups[h]) < 2 {
+				continue
+			}
+			if _, err := fmt.Fprintln(out, h); err != nil {
+				return nil, err
+			}
+			for _, p := range groups[h] {
+				if _, err := fmt.Fprintln(out, " ", p); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		return tracks, nil
+	})
+}
+
+// Verify checks the hash of each track against its file and reports the
+// missing files and the files whose content changed since the analysis. It
+// returns an error if any track is missing or stale. The playlist is left
+// untouched.
+func (list *Playlist) Verify(out io.Writer) error {
+	var bad int
+
+	err := list.view(func(tracks []Track) error {
+		for _, t := range tracks {
+			var problem string
+
+			switch h, err := hash(t.Path); {
+			case errors.Is(err, fs.ErrNotExist):
+				problem = "missing"
+			case err != nil:
+				return err
+			case h != t.Hash:
+				problem = "stale"
+			default:
+				continue
+			}
+
+			bad++
+
+			if _, err := fmt.Fprintf(out, "[%s] %s\n", problem, t.Path); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if bad > 0 {
+		return fmt.Errorf("%d tracks are missing or stale", bad)
+	}
+
+	return nil
+}
+
+// Prune remove files that are not a their reported location anymore.
+// It is based on the status() function, so this could have more criteria in
+// the near future.
+func (list *Playlist) Prune() error {
+	return list.Remove(io.Discard, Lost, false)
+}
+
+// Lost is a predicate for Remove matching the tracks whose file is missing.
+func Lost(t Track) bool {
+	return status(t) == fail
+}
+
+// Rebase replaces the old prefix of the track paths with the new one, after
+// the audio files moved, and returns the number of tracks changed. Prefixes
+// match whole path elements. Hashes are kept as the content is the same.
+func (list *Playlist) Rebase(oldPrefix, newPrefix string) (int, error) {
+	from, err := filepath.Abs(filepath.Clean(oldPrefix))
+	if err != nil {
+		return 0, err
+	}
+
+	to, err := filepath.Abs(filepath.Clean(newPrefix))
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+
+	err = list.update(func(tracks []Track) ([]Track, error) {
+		n = 0
+
+		seen := make(map[string]bool, len(tracks))
+		for i, t := range tracks {
+			if rel, err := filepath.Rel(from, t.Path); err == nil && filepath.IsLocal(rel) {
+				tracks[i].Path = filepath.Join(to, rel)
+			}
+
+			if seen[tracks[i].Path] {
+				return nil, fmt.Errorf("rebase would store two tracks at %s", tracks[i].Path)
+			}
+			seen[tracks[i].Path] = true
+
+			if tracks[i].Path != t.Path {
+				list.logger.Info("rebased", "from", t.Path, "track", tracks[i])
+				n++
+			}
+		}
+
+		return tracks, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// BelowQuality returns a predicate for Remove matching the tracks whose
+// quality score is below the given threshold, quality.Threshold being the
+// usual one. Tracks without a score (analyzed without a quality scanner) are
+// only matched if unscored is true.
+func BelowQuality(threshold float64, unscored bool) func(Track) bool {
+	return func(t Track) bool {
+		if !scored(t) {
+			return unscored
+		}
+		return t.Quality < threshold
+	}
+}
+
+// Remove deletes the tracks matching the given predicate and prints them to
+// out. If dry is true, the matching tracks are printed but the playlist is left
+// untouched.
+func (list *Playlist) Remove(out io.Writer, match func(Track) bool, dry bool) error {
+	return list.update(func(old []Track) ([]Track, error) {
+		tracks := make([]Track, 0)
+		for i := range old {
+			if !match(old[i]) {
+				tracks = append(tracks, old[i])
+				continue
+			}
+			if _, err := fmt.Fprintln(out, old[i]); err != nil {
+				return nil, err
+			}
+			if !dry {
+				list.logger.Info("removed", "track", old[i])
+			}
+		}
+
+		if dry {
+			return old, nil
+		}
+
+		return tracks, nil
+	})
+}
+
+// Bundle writes a tar archive of the playlist to out. If files is true, the
+// source audio files are included and the bundled paths are made relative to
+// the archive root. Otherwise, only the references are kept.
+func (list *Playlist) Bundle(out io.Writer, files bool) error {
+	return list.update(func(tracks []Track) ([]Track, error) {
+		tw := tar.NewWriter(out)
+
+		bundled := make([]Track, len(tracks))
+		copy(bundled, tracks)
+
+		for i := range bundled {
+			if !files {
+				break
+			}
+
+			if status(bundled[i]) == fail {
+				list.logger.Warn("missing", "track", bundled[i])
+				continue
+			}
+
+			name := path.Join(sources, bundled[i].Hash, filepath.Base(bundled[i].Path))
+			if err := archive(tw, bundled[i].Path, name); err != nil {
+				return nil, err
+			}
+
+			bundled[i].Path = name
+		}
+
+		data, err := json.Marshal(bundled)
+		if err != nil {
+			return nil, err
+		}
+
+		hdr := &tar.Header{Name: manifest, Mode: 0666, Size: int64(len(data)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+
+		return tracks, tw.Close()
+	})
+}
+
+// Unbundle restores an archive created by Bundle into the playlist. Bundled
+// files are extracted in the given directory and their paths are rewritten
+// accordingly. Tracks are merged by hash.
+func (list *Playlist) Unbundle(in io.Reader, dir string) error {
+	root, err := filepath.Abs(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+
+	var bundled []Track
+
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch name := filepath.FromSlash(hdr.Name); {
+		case hdr.Name == manifest:
+			if err := json.NewDecoder(tr).Decode(&bundled); err != nil {
+				return err
+			}
+		case hdr.Typeflag != tar.TypeReg:
+			continue
+		case !filepath.IsLocal(name):
+			return fmt.Errorf("unsafe path in bundle: %s", hdr.Name)
+		default:
+			if err := extract(tr, filepath.Join(root, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if bundled == nil {
+		return fmt.Errorf("missing %s in bundle", manifest)
+	}
+
+	return list.update(func(tracks []Track) ([]Track, error) {
+		for _, b := range bundled {
+			if !filepath.IsAbs(b.Path) {
+				b.Path = filepath.Join(root, filepath.FromSlash(b.Path))
+			}
+			tracks = merge(tracks, b)
+		}
+
+		order(tracks)
+
+		return tracks, nil
+	})
+}
+
+// SetFormat overrides the output format of the track matching the given path
+// or hash. An empty format restores the default one.
+func (list *Playlist) SetFormat(id, format string) error {
+	if _, ok := list.formats[format]; format != "" && !ok {
+		return fmt.Errorf("unsupported output format: %s", format)
+	}
+
+	return list.update(func(tracks []Track) ([]Track, error) {
+		i, err := lookup(tracks, id)
+		if err != nil {
+			return nil, err
+		}
+
+		tracks[i].Format = format
+
+		list.logger.Info("updated", "track", tracks[i])
+
+		return tracks, nil
+	})
+}
+
+// SetPreset moves the track matching the given path or hash to another preset
+// without analyzing it again. The preset range must contain the BPM of the
+// track.
+func (list *Playlist) SetPreset(id string, preset Preset) error {
+	return list.setPreset(id, preset, false)
+}
+
+// ForcePreset is like SetPreset but ignores the BPM range of the preset.
+func (list *Playlist) ForcePreset(id string, preset Preset) error {
+	return list.setPreset(id, preset, true)
+}
+
+func (list *Playlist) setPreset(id string, preset Preset, force bool) error {
+	if preset.Name == Auto.Name {
+		return errors.New("a track cannot be moved to the auto preset")
+	}
+
+	return list.update(func(tracks []Track) ([]Track, error) {
+		i, err := lookup(tracks, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if bpm := tracks[i].BPM; !force && (bpm < preset.Min || bpm > preset.Max) {
+			return nil, fmt.Errorf("%.2f BPM is out of the range of preset %s", bpm, preset.Name)
+		}
+
+		tracks[i].Preset = preset
+
+		list.logger.Info("updated", "track", tracks[i])
+
+		order(tracks)
+
+		return tracks, nil
+	})
+}
+
+// Evaluate measures the accuracy of the BPM detection against a CSV file of
+// manually verified values. Each record holds a path, the expected BPM and an
+// optional preset (default preset if empty). Per-file errors, the mean
+// absolute error and the rate of octave errors (half or double tempo) are
+// reported to out. The playlist is left untouched.
+func (list *Playlist) Evaluate(ctx context.Context, in io.Reader, out io.Writer) error {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	var total, octaves float64
+
+	for i, rec := range records {
+		if len(rec) < 2 {
+			return fmt.Errorf("invalid record on line %d", i+1)
+		}
+
+		want, err := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+		if err != nil {
+			return fmt.Errorf("invalid BPM on line %d: %w", i+1, err)
+		}
+
+		preset := list.presets[0]
+		if len(rec) > 2 && strings.TrimSpace(rec[2]) != "" {
+			if preset, err = list.PresetFromName(strings.TrimSpace(rec[2])); err != nil {
+				return err
+			}
+		}
+
+		got, _, _, err := analyze(ctx, list.logger, rec[0], preset, list.rate, list.pipeline(Analyze), list.bpm(), nil)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rec[0], err)
+		}
+
+		diff := got - want
+		if octave(want, got) {
+			octaves++
+		}
+
+		total += math.Abs(diff)
+
+		if _, err := fmt.Fprintf(out, "%s: want %.2f, got %.2f (%+.2f)\n", rec[0], want, got, diff); err != nil {
+			return err
+		}
+	}
+
+	if len(records) == 0 {
+		return errors.New("no records to evaluate")
+	}
+
+	n := float64(len(records))
+
+	_, err = fmt.Fprintf(out, "mean absolute error: %.2f\noctave errors: %.0f/%.0f (%.1f%%)\n",
+		total/n, octaves, n, 100*octaves/n)
+
+	return err
+}
+
+// Maximum relative deviation for a detected BPM to be considered an octave
+// error of the expected one.
+const octaveTolerance = 0.02
+
+// octave reports whether got is half or double the expected BPM.
+func octave(want, got float64) bool {
+	for _, f := range [...]float64{0.5, 2} {
+		if math.Abs(got-want*f) <= want*f*octaveTolerance {
+			return true
+		}
+	}
+	return false
+}
+
+// Analyze adds a track to the playlist and computes its BPM.
+func (list *Playlist) Analyze(ctx context.Context, path string, preset Preset) error {
+	return list.update(func(tracks []Track) ([]Track, error) {
+		abs, err := filepath.Abs(filepath.Clean(path))
+		if err != nil {
+			return nil, err
+		}
+
+		track, err := list.track(ctx, abs, preset)
+		if err != nil {
+			return nil, err
+		}
+
+		tracks, err = list.add(tracks, track)
+		if err != nil {
+			return nil, err
+		}
+
+		order(tracks)
+
+		return tracks, nil
+	})
+}
+
+// AnalyzeReader adds a track read from r to the playlist, like Analyze. The
+// given name identifies the track in place of a path. The hash is computed
+// from the streamed data. The codec, tags and quality probes need a file and
+// are skipped.
+func (list *Playlist) AnalyzeReader(ctx context.Context, r io.Reader, name string, preset Preset) error {
+	return list.update(func(tracks []Track) ([]Track, error) {
+		auto := preset == Auto
+		if auto {
+			preset = list.presets[0]
+		}
+
+		hash, bpm, duration, key, err := list.digest(ctx, r, preset)
+		if err != nil {
+			return nil, err
+		}
+
+		bpm, preset := list.settle(bpm, preset, auto)
+
+		track := Track{Path: name, Hash: hash, Preset: preset, BPM: bpm, Duration: duration, Key: key}
+
+		tracks, err = list.add(tracks, track)
+		if err != nil {
+			return nil, err
+		}
+
+		order(tracks)
+
+		return tracks, nil
+	})
+}
+
+// Inspect analyzes a file like Analyze but returns the track instead of adding
+// it to the playlist. The repository is not touched.
+func (list *Playlist) Inspect(ctx context.Context, path string, preset Preset) (Track, error) {
+	abs, err := filepath.Abs(filepath.Clean(path))
+	if err != nil {
+		return Track{}, err
+	}
+
+	return list.track(ctx, abs, preset)
+}
+
+// AnalyzeDir adds all audio files found in a directory and its subdirectories
+// to the playlist. Files are recognized by their extension, others are
+// skipped. The playlist is saved every checkpoint files so that an interrupted
+// run keeps most of its work: running it again skips the files already stored
+// under the same path with the same modification time. Errors are handled as
+// in Refresh.
+func (list *Playlist) AnalyzeDir(ctx context.Context, dir string, preset Preset) error {
+	abs, err := filepath.Abs(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0)
+
+	err = filepath.WalkDir(abs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, ok := codecs[strings.ToLower(filepath.Ext(path))]; ok && d.Type().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stored := make(map[string]int64)
+	err = list.view(func(tracks []Track) error {
+		for _, t := range tracks {
+			stored[t.Path] = t.Modified
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	todo := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if m, ok := stored[path]; ok && m != 0 && m == mtime(path) {
+			list.logger.Debug("unchanged", "path", path)
+			continue
+		}
+		todo = append(todo, path)
+	}
+
+	list.logger.Debug("resume", "skipped", len(paths)-len(todo), "remaining", len(todo))
+
+	tick := list.progressed(len(todo))
+
+	var errs []error
+
+	for len(todo) > 0 && ctx.Err() == nil {
+		n := min(checkpoint, len(todo))
+		if err := list.analyzeAll(ctx, todo[:n], preset, tick); err != nil {
+			errs = append(errs, err)
+			if list.failFast {
+				break
+			}
+		}
+		todo = todo[n:]
+	}
+
+	return errors.Join(errs...)
+}
+
+// Number of files analyzed by AnalyzeDir between two saves of the playlist.
+const checkpoint = 32
+
+// AnalyzeAll adds the given files to the playlist concurrently, in a single
+// transaction. Files sharing the same audio content end up in a single entry.
+// Errors are handled as in Refresh.
+func (list *Playlist) AnalyzeAll(ctx context.Context, paths []string, preset Preset) error {
+	return list.analyzeAll(ctx, paths, preset, list.progressed(len(paths)))
+}
+
+// analyzeAll implements AnalyzeAll, calling tick after each file.
+func (list *Playlist) analyzeAll(ctx context.Context, paths []string, preset Preset, tick func(Track)) error {
+	jobs := make([]Track, 0, len(paths))
+	for _, path := range paths {
+		abs, err := filepath.Abs(filepath.Clean(path))
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, Track{Path: abs})
+	}
+
+	var failed error
+
+	err := list.update(func(tracks []Track) ([]Track, error) {
+		n, err := limit(list.logger, list.concurrency(2), analyzeFDs)
+		if err != nil {
+			return nil, err
+		}
+
+		list.logger.Debug("workers", "n", n)
+
+		mu := new(sync.Mutex)
+
+		var added, updated int
+
+		do := func(t Track) error {
+			track, err := list.track(ctx, t.Path, preset)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			_, exists := lookup(tracks, track.Hash)
+
+			if tracks, err = list.add(tracks, track); err != nil {
+				return err
+			}
+
+			if exists == nil {
+				updated++
+			} else {
+				added++
+			}
+
+			return nil
+		}
+
+		failed = each(n, jobs, list.failFast, func(t Track) error { defer tick(t); return do(t) })
+		if failed != nil && list.failFast {
+			return nil, failed
+		}
+
+		list.logger.Info("analyzed", "added", added, "updated", updated)
+
+		order(tracks)
+
+		return tracks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return failed
+}
+
+// add inserts an analyzed track in the playlist or updates the existing entry
+// with the same audio content.
+func (list *Playlist) add(tracks []Track, track Track) ([]Track, error) {
+	if i, err := lookup(tracks, track.Hash); err == nil {
+		if list.warnDups && tracks[i].Path != track.Path {
+			list.logger.Warn("duplicate", "path", track.Path, "existing", tracks[i].Path)
+			return tracks, nil
+		}
+		track = carry(tracks[i], track)
+	}
+
+	if err := list.save(track); err != nil {
+		return tracks, err
+	}
+
+	list.logger.Info("analyzed", "track", track)
+
+	return merge(tracks, track), nil
+}
+
+// Operation is a handle on an asynchronous operation.
+type Operation struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Cancel cancels the operation. It returns immediately, use Done to wait for
+// the operation to actually stop.
+func (op *Operation) Cancel() { op.cancel() }
+
+// Done returns a channel closed when the operation is complete.
+func (op *Operation) Done() <-chan struct{} { return op.done }
+
+// Err returns the error of the operation once Done is closed.
+func (op *Operation) Err() error {
+	<-op.done
+	return op.err
+}
+
+func async(parent context.Context, f func(ctx context.Context) error) *Operation {
+	ctx, cancel := context.WithCancel(parent)
+	op := &Operation{cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(op.done)
+		defer cancel()
+		op.err = f(ctx)
+	}()
+
+	return op
+}
+
+// AnalyzeAsync runs Analyze in the background and returns a handle to cancel
+// it or wait for its completion.
+func (list *Playlist) AnalyzeAsync(ctx context.Context, path string, preset Preset) *Operation {
+	return async(ctx, func(ctx context.Context) error {
+		return list.Analyze(ctx, path, preset)
+	})
+}
+
+// CompileAsync runs Compile in the background and returns a handle to cancel
+// it or wait for its completion.
+func (list *Playlist) CompileAsync(ctx context.Context, path string) *Operation {
+	return async(ctx, func(ctx context.Context) error {
+		_, err := list.Compile(ctx, path)
+		return err
+	})
+}
+
+// Refresh re-analyzes all tracks in the playlist.
+func (list *Playlist) Refresh(ctx context.Context) error {
+	ctx, cancel := list.bounded(ctx)
+	defer cancel()
+
+	var failed error
+
+	err := list.update(func(old []Track) ([]Track, error) {
+		// Each job runs the analyze pipeline alongside the scanners.
+		n, err := limit(list.logger, list.concurrency(2), analyzeFDs)
+		if err != nil {
+			return nil, err
+		}
+
+		list.logger.Debug("workers", "n", n)
+
+		out, tracks, wg := make(chan Track, n), make([]Track, 0), new(sync.WaitGroup)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range out {
+				tracks = append(tracks, t)
+			}
+		}()
+
+		do := func(t Track) error {
+			// Recompute the appropriate preset from the last known BPM. It allows to
+			// change and move preset layout around freely.
+			if t.Preset.Name == "" {
+				t.Preset = list.classify(t.BPM)
+			}
+
+			if sc, ok := list.sidecar(t.Path); ok {
+				list.logger.Info("sidecar", "track", sc)
+				out <- sc
+				return nil
+			}
+
+			// Failed and skipped tracks are kept as they were.
+			if err := ctx.Err(); err != nil {
+				out <- t
+				return err
+			}
+
+			fresh, err := list.track(ctx, t.Path, t.Preset)
+			if err != nil {
+				out <- t
+				return err
+			}
+
+			t = carry(t, fresh)
+
+			list.logger.Info("refreshed", "track", t)
+
+			out <- t
+
+			return list.save(t)
+		}
+
+		tick := list.progressed(len(old))
+
+		failed = each(n, old, list.failFast, func(t Track) error { defer tick(t); return do(t) })
+
+		close(out)
+
+		wg.Wait()
+
+		// Completed tracks are saved on cancellation, even with fail-fast.
+		if failed != nil && list.failFast && ctx.Err() == nil {
+			return nil, failed
+		}
+
+		order(tracks)
+
+		return tracks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return failed
+}
+
+// Requality computes the quality score of all tracks again without analyzing
+// them, for example after installing sox(1). Tracks whose file is missing, and
+// tracks skipped on cancellation, are kept as they were.
+func (list *Playlist) Requality(ctx context.Context) error {
+	if list.quality == nil {
+		return errors.New("no quality scanner configured")
+	}
+
+	ctx, cancel := list.bounded(ctx)
+	defer cancel()
+
+	type result struct {
+		score  float64
+		scored bool
+	}
+
+	err := list.update(func(tracks []Track) ([]Track, error) {
+		n, err := limit(list.logger, list.concurrency(1), qualityFDs)
+		if err != nil {
+			return nil, err
+		}
+
+		mu, results := new(sync.Mutex), make(map[string]result, len(tracks))
+
+		tick := list.progressed(len(tracks))
+
+		each(n, tracks, false, func(t Track) error {
+			defer tick(t)
+
+			if status(t) == fail || ctx.Err() != nil {
+				return nil
+			}
+
+			score, ok := list.score(ctx, t.Path)
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			mu.Lock()
+			results[t.Path] = result{score, ok}
+			mu.Unlock()
+
+			return nil
+		})
+
+		for i := range tracks {
+			if r, ok := results[tracks[i].Path]; ok {
+				tracks[i].Quality, tracks[i].Scored = r.score, r.scored
+				list.logger.Info("scored", "track", tracks[i], "quality", r.score)
+			}
+		}
+
+		return tracks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return ctx.Err()
+}
+
+// Compile converts all files to a common format and exports them in a new
+// directory of the given one, classified by BPM. Tracks whose file is missing
+// are skipped. It returns the path of the created directory, also when some
+// tracks failed.
+func (list *Playlist) Compile(ctx context.Context, path string) (string, error) {
+	ctx, cancel := list.bounded(ctx)
+	defer cancel()
+
+	var failed error
+	var dir string
+
+	err := list.update(func(tracks []Track) ([]Track, error) {
+		var err error
+		if dir, err = list.outputDir(path); err != nil {
+			return nil, err
+		}
+
+		// Each job will spawn three FFMPEG processes.
+		n, err := limit(list.logger, list.concurrency(3), compileFDs)
+		if err != nil {
+			return nil, err
+		}
+
+		list.logger.Debug("workers", "n", n)
+
+		sorted := append([]Track(nil), tracks...)
+		order(sorted)
+
+		unique, err := names(sorted, list.extension, list.layout)
+		if err != nil {
+			return nil, err
+		}
+
+		m := loadCompiled(list.logger, dir, list.rebuild)
+
+		do := func(t Track) error {
+			c, ext, err := list.output(t)
+			if err != nil {
+				return err
+			}
+
+			o := unique[t.Path]
+
+			if m.unchanged(dir, o, ext, t.Hash) {
+				list.logger.Info("unchanged", "track", t)
+			} else if err := convert(ctx, list.logger, dir, t, o, ext, list.overwrite, c,
+				list.pipeline(Waveform),
+				list.pipeline(Spectrum),
+			); err != nil {
+				return err
+			}
+
+			m.record(o.audio+ext, t.Hash)
+
+			return nil
+		}
+
+		tick := list.progressed(len(tracks))
+
+		// Missing files would only make the pipelines fail. Tracks with a warn
+		// status (lossy or mislabeled) are readable by ffmpeg and converted:
+		// skipping them would leave out every MP3 of the playlist.
+		present := make([]Track, 0, len(tracks))
+		for _, t := range tracks {
+			if status(t) == fail {
+				list.logger.Warn("skipped", "track", t)
+				tick(t)
+				continue
+			}
+			present = append(present, t)
+		}
+
+		jobs, dups := present, [][2]Track(nil)
+		if list.dedup {
+			jobs, dups = duplicates(present, list.extension)
+		}
+
+		failed = each(n, jobs, list.failFast, func(t Track) error { defer tick(t); return do(t) })
+		if failed != nil && list.failFast {
+			return nil, errors.Join(failed, m.save(dir))
+		}
+
+		errs := []error{failed}
+
+		for _, pair := range dups {
+			o, ext := unique[pair[0].Path], list.extension(pair[0])
+
+			var err error
+			if !m.unchanged(dir, o, ext, pair[0].Hash) {
+				err = link(list.logger, dir, o, unique[pair[1].Path], ext, list.overwrite)
+			}
+
+			if tick(pair[0]); err == nil {
+				m.record(o.audio+ext, pair[0].Hash)
+				continue
+			}
+			if list.failFast {
+				return nil, errors.Join(err, m.save(dir))
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", pair[0].Path, err))
+		}
+
+		errs = append(errs, m.save(dir))
+
+		if list.sheets {
+			errs = append(errs, list.contactSheets(ctx, dir, sorted, unique))
+		}
+
+		failed = errors.Join(errs...)
+
+		list.logger.Info("compiled", "dir", dir)
+
+		return tracks, nil
+	})
+	if err != nil {
+		return dir, err
+	}
+
+	return dir, failed
+}
+
+// Name of the contact sheet written in each waveform directory.
+const contactSheet = "contactsheet.png"
+
+// contactSheets combines the compiled waveforms of the tracks, grouped by
+// directory, in order. Missing tracks and tracks without a waveform, such as
+// failed ones, are left out.
+func (list *Playlist) contactSheets(ctx context.Context, root string, tracks []Track, unique map[string]outputs) error {
+	if list.montage == nil {
+		return errors.New("no montage configured for contact sheets")
+	}
+
+	groups, dirs := make(map[string][]string), []string(nil)
+	for _, t := range tracks {
+		o, ok := unique[t.Path]
+		if !ok || status(t) == fail {
+			continue
+		}
+
+		_, wave, _ := o.in(root, list.extension(t))
+		if _, err := os.Stat(wave); err != nil {
+			continue
+		}
+
+		d := filepath.Dir(wave)
+		if _, ok := groups[d]; !ok {
+			dirs = append(dirs, d)
+		}
+		groups[d] = append(groups[d], wave)
+	}
+
+	var errs []error
+	for _, d := range dirs {
+		if err := list.contactSheet(ctx, filepath.Join(d, contactSheet), groups[d]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// contactSheet writes the montage of the given pictures to dst, replacing
+// the one of a previous compilation.
+func (list *Playlist) contactSheet(ctx context.Context, dst string, paths []string) error {
+	list.logger.Info("contact sheet", "path", dst, "n", len(paths))
+
+	p := PipelineFunc(func(ctx context.Context, _ io.Reader, out, err io.Writer) error {
+		return list.montage.Montage(ctx, paths, out, err)
+	})
+
+	return writeAtomic(dst, 0666, func(w io.Writer) error {
+		return run(ctx, list.logger, list.guarded(p), nil, w)
+	})
+}
+
+// outputDir creates the directory Compile writes to in the given destination.
+func (list *Playlist) outputDir(path string) (string, error) {
+	name := list.outDir
+	if name == "" {
+		name = "mkcdj-" + time.Now().Format("20060102-150405")
+	}
+
+	if strings.Contains(name, "*") {
+		return os.MkdirTemp(filepath.Clean(path), name)
+	}
+
+	dir := filepath.Join(path, name)
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// output returns the convert pipeline and the file extension of a track.
+func (list *Playlist) output(t Track) (Pipeline, string, error) {
+	format := t.Format
+	if format == "" {
+		format = list.format
+	}
+
+	if format == "" {
+		return list.pipeline(Convert), wav, nil
+	}
+
+	p, ok := list.formats[format]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported output format: %s", format)
+	}
+
+	return list.guarded(p), "." + format, nil
+}
+
+// progressed returns a function to call each time one of the total tracks is
+// processed. It reports the progress to the callback, if any.
+func (list *Playlist) progressed(total int) func(Track) {
+	var mu sync.Mutex
+	var done int
+
+	return func(t Track) {
+		if list.progress == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		done++
+		list.progress(done, total, t)
+	}
+}
+
+// save writes the sidecar file of a track if enabled.
+func (list *Playlist) save(t Track) error {
+	if !list.sidecars {
+		return nil
+	}
+
+	data, err := json.Marshal(&t)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(t.Path+sidecar, data, 0666)
+}
+
+// sidecar returns the track stored in the sidecar file of the given path if
+// enabled. The sidecar is ignored if the audio file changed since.
+func (list *Playlist) sidecar(path string) (Track, bool) {
+	if !list.sidecars {
+		return Track{}, false
+	}
+
+	data, err := os.ReadFile(path + sidecar)
+	if err != nil {
+		return Track{}, false
+	}
+
+	var t Track
+	if err := json.Unmarshal(data, &t); err != nil {
+		list.logger.Warn("sidecar", "path", path+sidecar, "err", err)
+		return Track{}, false
+	}
+
+	if h, err := hash(path); err != nil || h != t.Hash {
+		return Track{}, false
+	}
+
+	t.Path = path
+
+	return t, true
+}
+
+// extension returns the output file extension of a track.
+func (list *Playlist) extension(t Track) string {
+	_, ext, _ := list.output(t)
+	return ext
+}
+
+// update runs a transaction on the repository. Track presets are resolved
+// against the preset table of the playlist beforehand. Presets missing from
+// the table are kept as stored, with the range of the default preset if it is
+// unknown, so that changing the table never makes the repository unusable.
+func (list *Playlist) update(f func([]Track) ([]Track, error)) error {
+	return list.repository().Update(func(tracks []Track) ([]Track, error) {
+		stored, warned := make(map[string]string, len(tracks)), make(map[string]bool)
+		for i := range tracks {
+			p, err := list.PresetFromName(tracks[i].Preset.Name)
+			if err != nil {
+				p = tracks[i].Preset
+				if p.Min == 0 && p.Max == 0 {
+					p.Min, p.Max = list.presets[0].Min, list.presets[0].Max
+				}
+				if !warned[p.Name] {
+					list.logger.Warn("preset", "err", err, "min", p.Min, "max", p.Max)
+					warned[p.Name] = true
+				}
+			}
+			tracks[i].Preset = p
+
+			path := list.resolve(tracks[i].Path)
+			stored[path], tracks[i].Path = tracks[i].Path, path
+		}
+
+		res, err := f(tracks)
+		if err != nil || list.base == "" {
+			return res, err
+		}
+
+		// Paths are stored as they were read unless they changed.
+		res = slices.Clone(res)
+		for i := range res {
+			if path, ok := stored[res[i].Path]; ok {
+				res[i].Path = path
+			} else {
+				res[i].Path = list.relative(res[i].Path)
+			}
+		}
+
+		return res, nil
+	})
+}
+
+// view runs a read-only transaction on the repository. The function is given
+// a copy of the tracks so that the store is never rewritten.
+func (list *Playlist) view(f func([]Track) error) error {
+	return list.update(func(tracks []Track) ([]Track, error) {
+		return tracks, f(slices.Clone(tracks))
+	})
+}
+
+// resolve returns the absolute path of a stored track path.
+func (list *Playlist) resolve(path string) string {
+	if list.base == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(list.base, path)
+}
+
+// relative returns the path of a track to store: relative to the base
+// directory if it is in it, absolute otherwise.
+func (list *Playlist) relative(path string) string {
+	if list.base == "" {
+		return path
+	}
+	rel, err := filepath.Rel(list.base, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return path
+	}
+	return rel
+}
+
+func order(tracks []Track) {
+	sort.SliceStable(tracks, func(i, j int) bool {
+		if p := strings.Compare(tracks[i].Preset.Name, tracks[j].Preset.Name); p != 0 {
+			return p == -1
+		}
+		f1, f2 := filepath.Base(tracks[i].Path), filepath.Base(tracks[j].Path)
+		return strings.Compare(f1, f2) == -1
+	})
+}
+
+// lookup returns the index of the track matching the given path or hash.
+func lookup(tracks []Track, id string) (int, error) {
+	abs, err := filepath.Abs(filepath.Clean(id))
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range tracks {
+		if tracks[i].Hash == id || tracks[i].Path == abs {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown track: %s", id)
+}
+
+const (
+	// Estimated number of file descriptors used by a single job: opened files
+	// plus pipes to the external processes.
+	analyzeFDs = 12
+	compileFDs = 18
+	qualityFDs = 6
+
+	// File descriptors kept for the process itself (standard streams,
+	// repository file, runtime...).
+	reservedFDs = 32
+)
+
+// concurrency returns the configured number of workers, or a share of the
+// CPUs. It is never zero.
+func (list *Playlist) concurrency(share int) int {
+	if list.workers > 0 {
+		return list.workers
+	}
+	return max(1, runtime.NumCPU()/share)
+}
+
+// limit bounds the number of workers so that running n jobs using fds file
+// descriptors each doesn't exceed the soft limit of open files. The soft
+// limit is raised up to the hard limit if needed.
+func limit(logger *slog.Logger, n, fds int) (int, error) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return n, nil
+	}
+
+	want := uint64(n*fds + reservedFDs)
+	if rlim.Cur < want && rlim.Cur < rlim.Max {
+		raised := rlim
+		raised.Cur = min(want, rlim.Max)
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err == nil {
+			rlim = raised
+		}
+	}
+
+	if rlim.Cur < uint64(fds+reservedFDs) {
+		return 0, fmt.Errorf("too few file descriptors available (%d): increase ulimit -n", rlim.Cur)
+	}
+
+	if available := int((rlim.Cur - reservedFDs) / uint64(fds)); available < n {
+		logger.Warn("ulimit", "limit", rlim.Cur, "workers", available)
+		return available, nil
+	}
+
+	return n, nil
+}
+
+// merge replaces the track with the same hash or appends it.
+func merge(tracks []Track, t Track) []Track {
+	for i := range tracks {
+		if tracks[i].Hash == t.Hash {
+			tracks[i] = t
+			return tracks
+		}
+	}
+	return append(tracks, t)
+}
+
+// each runs do on all tracks with the given number of workers. Errors are
+// collected and returned together, each one prefixed with the path of the
+// track. With failFast, the remaining tracks are skipped after an error.
+func each(size int, tracks []Track, failFast bool, do func(t Track) error) error {
+	size = max(1, size)
+
+	wg, mu := new(sync.WaitGroup), new(sync.Mutex)
+	jobs, stop := make(chan Track), make(chan struct{})
+
+	var errs []error
+	var once sync.Once
+
+	wg.Add(size)
+
+	for i := 0; i < size; i++ {
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				err := do(t)
+				if err == nil {
+					continue
+				}
+
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", t.Path, err))
+				mu.Unlock()
+
+				if failFast {
+					once.Do(func() { close(stop) })
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, t := range tracks {
+		select {
+		case jobs <- t:
+		case <-stop:
+			break feed
+		}
+	}
+
+	close(jobs)
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// names returns the compiled files of each track given a layout, by path.
+// When any of the files of a track collides with a file of a previous track,
+// all of them are made unique with the beginning of the hash of the track.
+func names(tracks []Track, ext func(Track) string, layout Layout) (map[string]outputs, error) {
+	res, seen := make(map[string]outputs, len(tracks)), make(map[string]bool)
+
+	for _, t := range tracks {
+		var o outputs
+		o.audio, o.wave, o.spec = layout(t)
+
+		for _, p := range [...]string{o.audio, o.wave, o.spec} {
+			if !filepath.IsLocal(p) {
+				return nil, fmt.Errorf("invalid layout for %s: %q", t.Path, p)
+			}
+		}
+
+		files := func() []string {
+			return []string{o.audio + ext(t), o.wave + png, o.spec + png}
+		}
+
+		if slices.ContainsFunc(files(), func(p string) bool { return seen[p] }) {
+			suffix := fmt.Sprintf(" [%.8s]", t.Hash)
+			o = outputs{o.audio + suffix, o.wave + suffix, o.spec + suffix}
+		}
+
+		for _, p := range files() {
+			seen[p] = true
+		}
+
+		res[t.Path] = o
+	}
+
+	return res, nil
+}
+
+// outputs are the paths of the files compiled from a track, relative to the
+// output directory and without extension.
+type outputs struct {
+	audio, wave, spec string
+}
+
+// in returns the audio, waveform and spectrogram paths in an output directory.
+func (o outputs) in(root, ext string) (string, string, string) {
+	return filepath.Join(root, o.audio+ext),
+		filepath.Join(root, o.wave+png),
+		filepath.Join(root, o.spec+png)
+}
+
+func rename(t Track) string {
+	base, ext := filepath.Base(t.Path), filepath.Ext(t.Path)
+	name := base[:len(base)-len(ext)]
+	if t.Artist != "" && t.Title != "" {
+		name = t.Artist + " - " + t.Title
+	}
+	path := fmt.Sprintf("%.0f - %s", math.Round(t.BPM), sanitize(name))
+	return filepath.Join(t.Preset.Name, path)
+}
+
+// sanitize replaces the path separators and control characters of a file
+// name with a dash.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '-'
+		}
+		return r
+	}, name)
+}
+
+func (list *Playlist) track(ctx context.Context, path string, preset Preset) (Track, error) {
+	// Taken first so that a file changed during the analysis is analyzed again.
+	modified := mtime(path)
+
+	auto := preset == Auto
+	if auto {
+		preset = list.presets[0]
+	}
+
+	wg := new(sync.WaitGroup)
+	wg.Add(5)
+
+	hc, cc, kc, tc := make(chan string, 1), make(chan string, 1), make(chan string, 1), make(chan Tags, 1)
+	bc, dc, qc, lc := make(chan float64, 1), make(chan float64, 1), make(chan float64, 1), make(chan float64, 1)
+	sc := make(chan bool, 1)
+	sink := make(chan error, 5)
+
+	go func() {
+		defer wg.Done()
+		hash, bpm, duration, key, err := list.measure(ctx, path, preset)
+		hc <- hash
+		bc <- bpm
+		dc <- duration
+		kc <- key
+		sink <- err
+	}()
+
+	// Secondary measurements are best-effort: the field is left empty if
+	// they fail, as with the quality score.
+	go func() {
+		defer wg.Done()
+		codec, err := probe(ctx, path, list.prober)
+		cc <- codec
+		sink <- list.secondary(ctx, "codec", path, err)
+	}()
+
+	go func() {
+		defer wg.Done()
+		score, ok := list.score(ctx, path)
+		qc <- score
+		sc <- ok
+		sink <- nil
+	}()
+
+	go func() {
+		defer wg.Done()
+		lufs, err := loudness(ctx, path, list.loudness)
+		lc <- lufs
+		sink <- list.secondary(ctx, "loudness", path, err)
+	}()
+
+	go func() {
+		defer wg.Done()
+		tags, err := tags(ctx, path, list.tagger)
+		tc <- tags
+		sink <- list.secondary(ctx, "tags", path, err)
+	}()
+
+	wg.Wait()
+
+	close(hc)
+	close(bc)
+	close(dc)
+	close(cc)
+	close(qc)
+	close(sc)
+	close(lc)
+	close(kc)
+	close(tc)
+
+	close(sink)
+
+	for err := range sink {
+		if err != nil {
+			return Track{}, err
+		}
+	}
+
+	bpm, preset := list.settle(<-bc, preset, auto)
+
+	t := Track{Path: path, Hash: <-hc, Preset: preset, BPM: bpm, Codec: <-cc}
+	t.Duration, t.Quality, t.Scored, t.LUFS, t.Key = <-dc, <-qc, <-sc, <-lc, <-kc
+	t.Modified = modified
+	tags := <-tc
+	t.Artist, t.Title = tags.Artist, tags.Title
+	if mislabeled(t) {
+		list.logger.Warn("mislabeled", "codec", t.Codec, "track", t)
+	}
+
+	return t, nil
+}
+
+// settle returns the final BPM of a track scanned with the given preset, and
+// the preset it belongs to.
+//
+// TODO: auto-classification should fall back to the default preset and flag
+// the track for review when the detection confidence is low, so that unsure
+// tracks close to a boundary don't end up in a genre preset. It needs the BPM
+// scanners to report a confidence value, which they don't yet.
+func (list *Playlist) settle(bpm float64, preset Preset, auto bool) (float64, Preset) {
+	if list.folding {
+		bpm = fold(list.logger, bpm, preset)
+	}
+
+	if auto {
+		preset = list.classify(bpm)
+	}
+
+	return round(bpm, list.precision), preset
+}
+
+// fold brings a BPM detected at half or double the actual tempo back into the
+// range of the preset. The value is returned unchanged if no factor fits.
+func fold(logger *slog.Logger, bpm float64, preset Preset) float64 {
+	if preset.Min <= bpm && bpm <= preset.Max {
+		return bpm
+	}
+
+	for _, f := range [...]float64{2, 0.5} {
+		if v := bpm * f; preset.Min <= v && v <= preset.Max {
+			logger.Debug("fold", "factor", f, "from", bpm, "to", v)
+			return v
+		}
+	}
+
+	return bpm
+}
+
+// round rounds a value to the given number of decimals.
+func round(v float64, decimals int) float64 {
+	if decimals < 0 {
+		return v
+	}
+	p := math.Pow(10, float64(decimals))
+	return math.Round(v*p) / p
+}
+
+// carry copies the user-defined settings of a track to its re-analyzed version.
+func carry(old, t Track) Track {
+	t.Format = old.Format
+	return t
+}
+
+// secondary logs the error of a secondary measurement and drops it, unless
+// the analysis was canceled.
+func (list *Playlist) secondary(ctx context.Context, name, path string, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	list.logger.Warn(name, "path", path, "err", err)
+	return nil
+}
+
+func probe(ctx context.Context, path string, p CodecProber) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+	return p.Probe(ctx, path)
+}
+
+func tags(ctx context.Context, path string, p TagsProber) (Tags, error) {
+	if p == nil {
+		return Tags{}, nil
+	}
+	return p.Tags(ctx, path)
+}
+
+// score returns the quality score of a file and whether it was scored.
+// Scoring is best-effort: the track is left unscored if it fails.
+func (list *Playlist) score(ctx context.Context, path string) (float64, bool) {
+	if list.quality == nil {
+		return 0, false
+	}
+
+	score, err := list.quality.Quality(ctx, path)
+	switch {
+	case errors.Is(err, quality.ErrUnsupported):
+		list.logger.Debug("unscored", "path", path, "err", err)
+	case err != nil:
+		list.logger.Warn("unscored", "path", path, "err", err)
+	}
+
+	return score, err == nil
+}
+
+func loudness(ctx context.Context, path string, s LoudnessScanner) (float64, error) {
+	if s == nil {
+		return 0, nil
+	}
+	return s.Loudness(ctx, path)
+}
+
+// mtime returns the modification time of a file in Unix nanoseconds, or 0 if
+// it can't be read.
+func mtime(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.ModTime().UnixNano()
+}
+
+func hash(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// measure returns the hash, the BPM, the duration and the key of a file,
+// reading it only once.
+func (list *Playlist) measure(ctx context.Context, path string, preset Preset) (string, float64, float64, string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", 0, 0, "", err
+	}
+	defer fd.Close()
+
+	return list.digest(ctx, fd, preset)
+}
+
+// digest is like measure for audio data read from a Reader. The data is
+// hashed while it streams to the analyze pipeline.
+func (list *Playlist) digest(ctx context.Context, r io.Reader, preset Preset) (string, float64, float64, string, error) {
+	h := sha256.New()
+
+	bpm, duration, key, err := stream(ctx, list.logger, io.TeeReader(r, h), preset, list.rate, list.pipeline(Analyze), list.bpm(), list.keys)
+	if err != nil {
+		return "", 0, 0, "", err
+	}
+
+	// The pipeline may not consume all of its input.
+	if _, err := io.Copy(h, r); err != nil {
+		return "", 0, 0, "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), bpm, duration, key, nil
+}
+
+// analyze returns the BPM, the duration in seconds and the key of an audio
+// file decoded at the given sample rate.
+func analyze(ctx context.Context, logger *slog.Logger, path string, preset Preset, rate int, p Pipeline, s BPMScanner, k KeyScanner) (float64, float64, string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer fd.Close()
+
+	return stream(ctx, logger, fd, preset, rate, p, s, k)
+}
+
+// stream is like analyze for audio data read from a Reader.
+func stream(ctx context.Context, logger *slog.Logger, in io.Reader, preset Preset, rate int, p Pipeline, s BPMScanner, k KeyScanner) (float64, float64, string, error) {
+	// Stream the decoded signal to the scanners so that decoding and scanning
+	// overlap and memory stays bounded. Errors of the pipeline are forwarded to
+	// the scanners through the pipes.
+	pr, pw := io.Pipe()
+	kr, kw := io.Pipe()
+	done, keys := make(chan error, 1), make(chan error, 1)
+
+	var w io.Writer = pw
+	if k != nil {
+		w = io.MultiWriter(pw, kw)
+	}
+
+	// Count the decoded samples to compute the duration.
+	c := &counter{w: w}
+
+	go func() {
+		err := run(ctx, logger, p, bufio.NewReader(in), c)
+		pw.CloseWithError(err)
+		kw.CloseWithError(err)
+		done <- err
+	}()
+
+	var key string
+
+	go func() {
+		var err error
+		if k != nil {
+			key, err = k.Key(bufio.NewReader(kr))
+		}
+		// Key detection is auxiliary: a failure leaves the key empty.
+		if err != nil {
+			logger.Warn("no key", "err", err)
+			key = ""
+		}
+		keys <- drain(kr, nil)
+	}()
+
+	bpm, err := scanBPM(ctx, s, bufio.NewReader(pr), preset.Min, preset.Max)
+	err = drain(pr, err)
+
+	kerr, perr := <-keys, <-done
+
+	// A scanner failing closes its pipe with its error, which makes the
+	// pipeline fail too: report the original error.
+	for _, e := range [...]error{err, kerr, perr} {
+		if e != nil {
+			return 0, 0, "", e
+		}
+	}
+
+	return bpm, float64(c.n) / f32 / float64(rate), key, nil
+}
+
+// drain reads what is left in the pipe of a scanner which returned, so that
+// the pipeline keeps feeding the other one. The pipe is closed with the error
+// of a failed scanner instead, which stops the pipeline.
+func drain(r *io.PipeReader, err error) error {
+	if err != nil {
+		r.CloseWithError(err)
+		return err
+	}
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// counter is an io.Writer counting the bytes written through it.
+type counter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements io.Writer for counter.
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func convert(ctx context.Context, logger *slog.Logger, root string, t Track, o outputs, ext string, policy OverwritePolicy, c, w, s Pipeline) error {
+	logger.Info("converting", "track", t)
+
+	wg, sink := new(sync.WaitGroup), make(chan error, 3)
+	wg.Add(3)
+
+	audio, wave, spec := o.in(root, ext)
+
+	go func() {
+		defer wg.Done()
+		sink <- build(ctx, logger, t.Path, audio, c, policy)
+	}()
+
+	go func() {
+		defer wg.Done()
+		sink <- build(ctx, logger, t.Path, wave, w, policy)
+	}()
+
+	go func() {
+		defer wg.Done()
+		sink <- build(ctx, logger, t.Path, spec, s, policy)
+	}()
+
+	wg.Wait()
+
+	close(sink)
+
+	for err := range sink {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compiledFile is the name of the file of an output directory recording the
+// source hash of each compiled track.
+const compiledFile = "manifest.json"
+
+// compiled records the source hash of the audio files of an output directory,
+// relative to it, so that unchanged tracks are not
+// converted again by the next compilation.
+type compiled struct {
+	mu   sync.Mutex
+	old  map[string]string // As found at the beginning of the compilation.
+	next map[string]string // Tracks compiled or found unchanged.
+}
+
+// loadCompiled reads the manifest of an output directory. A missing or
+// invalid manifest, or a rebuild, makes all tracks look changed.
+func loadCompiled(logger *slog.Logger, dir string, rebuild bool) *compiled {
+	m := &compiled{old: make(map[string]string), next: make(map[string]string)}
+	if rebuild {
+		return m
+	}
+
+	err := decodeFile(filepath.Join(dir, compiledFile), JSON, &m.old)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Warn("manifest", "dir", dir, "err", err)
+		m.old = make(map[string]string)
+	}
+
+	return m
+}
+
+// unchanged tells whether the outputs of a track were compiled from the same
+// audio content and still exist.
+func (m *compiled) unchanged(dir string, o outputs, ext, hash string) bool {
+	if m.old[o.audio+ext] != hash {
+		return false
+	}
+
+	audio, wave, spec := o.in(dir, ext)
+	for _, dst := range [...]string{audio, wave, spec} {
+		if _, err := os.Stat(dst); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// record adds a compiled track to the manifest.
+func (m *compiled) record(file, hash string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next[file] = hash
+}
+
+// save writes the manifest in the output directory.
+func (m *compiled) save(dir string) error {
+	return writeAtomic(filepath.Join(dir, compiledFile), 0666, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(m.next)
+	})
+}
+
+// duplicates splits tracks between the ones to convert and the ones sharing
+// the same audio content and output extension as a previous track. The latter
+// are returned as pairs of duplicate and original tracks.
+func duplicates(tracks []Track, ext func(Track) string) ([]Track, [][2]Track) {
+	seen := make(map[string]Track)
+	unique, dups := make([]Track, 0, len(tracks)), make([][2]Track, 0)
+
+	for _, t := range tracks {
+		key := t.Hash + ext(t)
+		if o, ok := seen[key]; ok {
+			dups = append(dups, [2]Track{t, o})
+			continue
+		}
+		seen[key] = t
+		unique = append(unique, t)
+	}
+
+	return unique, dups
+}
+
+// link hardlinks the compiled files of the original track to the paths of
+// its duplicate.
+func link(logger *slog.Logger, root string, dup, o outputs, ext string, policy OverwritePolicy) error {
+	logger.Info("link", "path", dup.audio, "to", o.audio)
+
+	a1, w1, s1 := o.in(root, ext)
+	a2, w2, s2 := dup.in(root, ext)
+
+	for _, pair := range [...][2]string{{a1, a2}, {w1, w2}, {s1, s2}} {
+		if err := os.MkdirAll(filepath.Dir(pair[1]), 0755); err != nil {
+			return err
+		}
+
+		switch skip, err := existing(logger, pair[1], policy); {
+		case err != nil:
+			return err
+		case skip:
+			continue
+		}
+
+		if err := os.Link(pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func build(ctx context.Context, logger *slog.Logger, src, dst string, p Pipeline, policy OverwritePolicy) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	switch skip, err := existing(logger, dst, policy); {
+	case err != nil:
+		return err
+	case skip:
+		return nil
+	}
+
+	// A failed conversion must not leave a partial file behind, which would
+	// look compiled to the overwrite policy and to the manifest.
+	return writeAtomic(dst, 0666, func(w io.Writer) error {
+		return run(ctx, logger, p, in, w)
+	})
+}
+
+// existing applies the overwrite policy to a destination path. It reports
+// whether the destination must be kept as is, and removes it if it must be
+// replaced.
+func existing(logger *slog.Logger, dst string, policy OverwritePolicy) (bool, error) {
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	switch policy {
+	case SkipExisting:
+		logger.Info("kept", "path", dst)
+		return true, nil
+	case OverwriteExisting:
+		logger.Info("overwritten", "path", dst)
+		return false, os.Remove(dst)
+	default:
+		return false, fmt.Errorf("about to overwrite: %s", dst)
+	}
+}
+
+// run runs a pipeline. Its standard error is logged on success and its last
+// lines are appended to the error on failure.
+func run(ctx context.Context, logger *slog.Logger, p Pipeline, stdin io.Reader, stdout io.Writer) error {
+	stderr := bytes.NewBuffer(nil)
+
+	err := p.Run(ctx, stdin, stdout, stderr)
+
+	message := tail(stderr.String(), stderrLines)
+	switch {
+	case message == "":
+		return err
+	case err != nil:
+		return fmt.Errorf("%w: %s", err, message)
+	}
+
+	logger.Debug("stderr", "tail", message)
+
+	return nil
+}
+
+// Number of trailing lines of the standard error reported by run.
+const stderrLines = 5
+
+// tail returns the last n non-blank lines of s, trimmed and joined with "; ".
+func tail(s string, n int) string {
+	lines := make([]string, 0, n)
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines[max(0, len(lines)-n):], "; ")
+}
+
+const (
+	// Status strings.
+	good = "good"
+	warn = "warn"
+	fail = "fail"
+
+	// Default analysis sample rate and size in bytes of a f32le sample.
+	rate = 44100
+	f32  = 4
+
+	// File extensions.
+	wav  = ".wav"
+	flac = ".flac"
+	png  = ".png"
+)
+
+func status(t Track) string {
+	ext := filepath.Ext(t.Path)
+	switch _, err := os.Stat(t.Path); {
+	case err != nil:
+		return fail
+	case ext != wav && ext != flac:
+		return warn
+	case mislabeled(t):
+		return warn
+	default:
+		return good
+	}
+}
 
-			log.Println(t)
+// Expected codec name prefixes by file extension.
+var codecs = map[string][]string{
+	wav:     {"pcm_"},
+	flac:    {"flac"},
+	".mp3":  {"mp3"},
+	".ogg":  {"vorbis", "opus", "flac"},
+	".opus": {"opus"},
+	".m4a":  {"aac", "alac"},
+	".aac":  {"aac"},
+	".aiff": {"pcm_"},
+}
 
-			out <- t
+// mislabeled reports whether the detected codec of a track doesn't match its
+// file extension. Unknown codecs and extensions are given the benefit of the
+// doubt.
+func mislabeled(t Track) bool {
+	prefixes, ok := codecs[strings.ToLower(filepath.Ext(t.Path))]
+	if t.Codec == "" || !ok {
+		return false
+	}
 
-			return nil
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(t.Codec, prefix) {
+			return false
 		}
+	}
 
-		if err := each(n, old, do); err != nil {
-			close(out)
-			wg.Wait()
-			return nil, err
-		}
+	return true
+}
 
-		close(out)
+const (
+	// Sidecar file suffix.
+	sidecar = ".mkcdj.json"
 
-		wg.Wait()
+	// Bundle layout.
+	manifest = "mkcdj.json"
+	sources  = "files"
+)
 
-		order(tracks)
+func archive(tw *tar.Writer, src, name string) error {
+	fd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
 
-		return tracks, nil
-	})
-}
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
 
-// Compile converts all files to a common format and exports them in the given
-// directory classified by BPM.
-func (list *Playlist) Compile(ctx context.Context, path string) error {
-	return withJSONFile(list.path, func(tracks []Track) ([]Track, error) {
-		dir, err := os.MkdirTemp(filepath.Clean(path), "mkcdj-*")
-		if err != nil {
-			return nil, err
-		}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
 
-		// Each job will spawn three FFMPEG processes.
-		var n = runtime.NumCPU() / 3
+	hdr.Name = name
 
-		log.Println("[workers]", n)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
 
-		do := func(t Track) error {
-			return convert(ctx, dir, t,
-				list.pipelines[Convert],
-				list.pipelines[Waveform],
-				list.pipelines[Spectrum],
-			)
-		}
+	_, err = io.Copy(tw, fd)
+	return err
+}
 
-		if err := each(n, tracks, do); err != nil {
-			return nil, err
-		}
+func extract(r io.Reader, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
 
-		log.Println("[done]", dir)
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
 
-		return tracks, nil
-	})
-}
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
 
-func order(tracks []Track) {
-	sort.SliceStable(tracks, func(i, j int) bool {
-		if p := strings.Compare(tracks[i].Preset.Name, tracks[j].Preset.Name); p != 0 {
-			return p == -1
-		}
-		f1, f2 := filepath.Base(tracks[i].Path), filepath.Base(tracks[j].Path)
-		return strings.Compare(f1, f2) == -1
-	})
+	return out.Close()
 }
 
-func each(size int, tracks []Track, do func(t Track) error) error {
-	wg := new(sync.WaitGroup)
-	jobs := make(chan Track, size)
-	sink := make(chan error, size)
+// withJSONFile runs a transaction on a repository file. The file is replaced
+// atomically so that a crash never leaves it half-written. Since replacing
+// the file changes its inode, the exclusive lock is held on a separate lock
+// file next to it.
+func withJSONFile[T any](s JSONFile, f func(data T) (T, error)) error {
+	path := filepath.Clean(s.Path)
 
-	teardown := func() {
-		close(jobs)
-		wg.Wait()
-		close(sink)
+	if path == stdin {
+		return withStdin(s.Format, f)
 	}
 
-	wg.Add(size)
-
-	for i := 0; i < size; i++ {
-		go func() {
-			defer wg.Done()
-			for t := range jobs {
-				sink <- do(t)
-			}
-		}()
+	unlock, err := lock(s.logger(), path, !s.Unlocked)
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	var once sync.Once
-	defer once.Do(teardown)
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("could not open file at path %q: %w", path, err)
+	}
+	defer file.Close()
 
-	go func() {
-		defer once.Do(teardown)
-		for _, t := range tracks {
-			jobs <- t
-		}
-	}()
+	// A new or empty file holds the zero value.
+	var data T
+	if err := s.Format.decode(file, &data); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("could not decode data in file at path %q: %w", path, err)
+	}
 
-	for err := range sink {
-		if err != nil {
-			return err
-		}
+	// f may modify the data in place: compare encoded snapshots.
+	before, err := snapshot(s.Format, data)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	replace, err := f(data)
+	if err != nil {
+		return err
+	}
 
-func rename(t Track) string {
-	base, ext := filepath.Base(t.Path), filepath.Ext(t.Path)
-	name := base[:len(base)-len(ext)]
-	path := fmt.Sprintf("%.0f - %s", math.Round(t.BPM), name)
-	return filepath.Join(t.Preset.Name, path)
-}
+	after, err := snapshot(s.Format, replace)
+	if err != nil {
+		return err
+	}
 
-func track(ctx context.Context, path string, preset Preset, p Pipeline, s BPMScanner) (Track, error) {
-	wg := new(sync.WaitGroup)
-	wg.Add(2)
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat file at path %q: %w", path, err)
+	}
 
-	hc, bc := make(chan string, 1), make(chan float64, 1)
-	sink := make(chan error, 2)
+	// Read-only transactions neither rotate the backups nor touch the file.
+	if info.Size() > 0 && bytes.Equal(before, after) {
+		return nil
+	}
 
-	go func() {
-		defer wg.Done()
-		hash, err := hash(path)
-		hc <- hash
-		sink <- err
-	}()
+	// Backups are only rotated once the new version is safely written.
+	commit := func() error {
+		if info.Size() == 0 {
+			return nil
+		}
+		return rotate(path, s.Backups)
+	}
 
-	go func() {
-		defer wg.Done()
-		bpm, err := analyze(ctx, path, preset, p, s)
-		bc <- bpm
-		sink <- err
-	}()
+	return replaceAtomic(path, info.Mode().Perm(), func(w io.Writer) error {
+		_, err := w.Write(after)
+		return err
+	}, commit)
+}
 
-	wg.Wait()
+// snapshot returns the encoding of data in the given format.
+func snapshot(format StoreFormat, data any) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := format.encode(buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	close(hc)
-	close(bc)
+// stdin is the repository path standing for the standard input.
+const stdin = "-"
 
-	close(sink)
+// withStdin runs a read-only transaction on data read from the standard input.
+// Since there is nowhere to save it, f must return the data unchanged.
+func withStdin[T any](format StoreFormat, f func(data T) (T, error)) error {
+	var data T
+	if err := format.decode(os.Stdin, &data); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("could not decode data from the standard input: %w", err)
+	}
 
-	for err := range sink {
-		if err != nil {
-			return Track{}, err
-		}
+	// f may modify the data in place: compare encoded snapshots.
+	before, err := snapshot(format, data)
+	if err != nil {
+		return err
 	}
 
-	return Track{Path: path, Hash: <-hc, Preset: preset, BPM: <-bc}, nil
-}
+	replace, err := f(data)
+	if err != nil {
+		return err
+	}
 
-func hash(path string) (string, error) {
-	fd, err := os.Open(path)
+	after, err := snapshot(format, replace)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer fd.Close()
 
-	h := sha256.New()
-	if _, err := io.Copy(h, fd); err != nil {
-		return "", err
+	if !bytes.Equal(before, after) {
+		return errors.New("the repository read from the standard input is read-only")
 	}
 
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+	return nil
 }
 
-func analyze(ctx context.Context, path string, preset Preset, p Pipeline, s BPMScanner) (float64, error) {
-	fd, err := os.Open(path)
+// lock acquires an exclusive lock for the file at the given path and returns
+// the function releasing it.
+//
+// The lock is a flock(2) advisory lock, released by the kernel if the process
+// dies. Some network file systems don't support it: the lock then falls back
+// to the exclusive creation of a marker file, which works everywhere but is
+// left behind by a crash and must be removed by hand.
+func lock(logger *slog.Logger, path string, enabled bool) (func(), error) {
+	if !enabled {
+		return func() {}, nil
+	}
+
+	fd, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("could not open lock file for path %q: %w", path, err)
 	}
-	defer fd.Close()
 
-	buf := bytes.NewBuffer(nil)
+	err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX)
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.ENOLCK) {
+		fd.Close()
+		logger.Warn("lock fallback", "path", path, "err", err)
+		return marker(path + ".lck")
+	}
 
-	if err := run(ctx, p, bufio.NewReader(fd), buf); err != nil {
-		return 0, err
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("could not acquire exclusive lock on file at path %q: %w", path, err)
 	}
 
-	return s.Scan(buf, preset.Min, preset.Max)
+	return func() {
+		syscall.Flock(int(fd.Fd()), syscall.LOCK_UN) //nolint:errcheck
+		fd.Close()
+	}, nil
 }
 
-func convert(ctx context.Context, root string, t Track, c, w, s Pipeline) error {
-	log.Println(t)
+// Maximum time to wait for a lock marker file to be removed.
+const markerTimeout = 30 * time.Second
 
-	wg, sink := new(sync.WaitGroup), make(chan error, 3)
-	wg.Add(3)
-
-	dst := func(dir, suffix string) string {
-		return filepath.Join(dir, rename(t)+suffix)
-	}
+// marker acquires a lock by creating the file at the given path, waiting for
+// it to be removed if it exists.
+func marker(path string) (func(), error) {
+	deadline := time.Now().Add(markerTimeout)
 
-	audio := filepath.Join(root, "audio")
-	waves := filepath.Join(root, "waveforms")
-	specs := filepath.Join(root, "spectrograms")
+	for {
+		fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			fd.Close()
+			return func() { os.Remove(path) }, nil
+		}
 
-	go func() {
-		defer wg.Done()
-		sink <- build(ctx, t.Path, dst(audio, wav), c)
-	}()
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("could not create lock file at path %q: %w", path, err)
+		}
 
-	go func() {
-		defer wg.Done()
-		sink <- build(ctx, t.Path, dst(waves, png), w)
-	}()
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("lock file at path %q still exists: remove it if no other process is running", path)
+		}
 
-	go func() {
-		defer wg.Done()
-		sink <- build(ctx, t.Path, dst(specs, png), s)
-	}()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
 
-	wg.Wait()
+// backup returns the path of the i-th most recent backup of a file.
+func backup(path string, i int) string {
+	if i == 0 {
+		return path + ".bak"
+	}
+	return fmt.Sprintf("%s.bak.%d", path, i)
+}
 
-	close(sink)
+// rotate shifts the existing backups of a file and hardlinks the current
+// version as the most recent backup, or copies it on file systems without
+// hardlinks. The oldest backup is dropped.
+func rotate(path string, n int) error {
+	if n <= 0 {
+		return nil
+	}
 
-	for err := range sink {
-		if err != nil {
-			return err
+	for i := n - 1; i > 0; i-- {
+		err := os.Rename(backup(path, i-1), backup(path, i))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("could not rotate backups of file at path %q: %w", path, err)
 		}
 	}
 
-	return nil
-}
+	if err := os.Remove(backup(path, 0)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not rotate backups of file at path %q: %w", path, err)
+	}
 
-func build(ctx context.Context, src, dst string, p Pipeline) error {
-	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
-		return err
+	if err := os.Link(path, backup(path, 0)); err == nil {
+		return nil
 	}
 
-	in, err := os.Open(src)
+	src, err := os.Open(path)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not backup file at path %q: %w", path, err)
 	}
-	defer in.Close()
+	defer src.Close()
 
-	if _, err := os.Stat(dst); !os.IsNotExist(err) {
-		return fmt.Errorf("about to overwrite: %s", dst)
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("could not backup file at path %q: %w", path, err)
 	}
 
-	out, err := os.Create(dst)
+	return writeAtomic(backup(path, 0), info.Mode().Perm(), func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// restore replaces a file that cannot be decoded with its most recent backup
+// that can.
+func restore[T any](s JSONFile) error {
+	path, n := filepath.Clean(s.Path), s.Backups
+
+	if path == stdin {
+		return errors.New("the standard input has no backups")
+	}
+
+	unlock, err := lock(s.logger(), path, !s.Unlocked)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	defer unlock()
 
-	return run(ctx, p, in, out)
-}
+	var data T
 
-func run(parent context.Context, p Pipeline, stdin io.Reader, stdout io.Writer) error {
-	ctx, cancel := context.WithTimeout(parent, 1*time.Minute)
-	defer cancel()
+	if err := decodeFile(path, s.Format, &data); err == nil {
+		return fmt.Errorf("file at path %q is valid, nothing to restore", path)
+	}
 
-	stderr := bytes.NewBuffer(nil)
+	for i := 0; i < n; i++ {
+		raw, err := os.ReadFile(backup(path, i))
+		if err != nil || s.Format.decode(bytes.NewReader(raw), &data) != nil {
+			continue
+		}
 
-	err := p.Run(ctx, stdin, stdout, stderr)
+		s.logger().Info("restored", "backup", backup(path, i))
 
-	line, _ := stderr.ReadString(0x0A)
-	if message := strings.TrimSpace(line); message != "" {
-		log.Println(message)
+		return writeAtomic(path, 0666, func(w io.Writer) error {
+			_, err := w.Write(raw)
+			return err
+		})
 	}
 
-	return err
+	return fmt.Errorf("no valid backup found for file at path %q", path)
 }
 
-const (
-	// Status strings.
-	good = "good"
-	warn = "warn"
-	fail = "fail"
-
-	// File extensions.
-	wav  = ".wav"
-	flac = ".flac"
-	png  = ".png"
-)
-
-func status(t Track) string {
-	ext := filepath.Ext(t.Path)
-	switch _, err := os.Stat(t.Path); {
-	case err != nil:
-		return fail
-	case ext != wav && ext != flac:
-		return warn
-	default:
-		return good
+func decodeFile(path string, format StoreFormat, v any) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
 	}
+	return format.decode(bytes.NewReader(raw), v)
+}
+
+// writeAtomic writes a file by writing a temporary file in the same directory
+// and renaming it over the destination once synced to disk.
+func writeAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	return replaceAtomic(path, perm, write, func() error { return nil })
 }
 
-func withJSONFile[T any](path string, f func(data T) (T, error)) error {
-	file, err := os.OpenFile(filepath.Clean(path), os.O_RDWR|os.O_CREATE, 0666)
+// replaceAtomic is writeAtomic running commit once the temporary file is
+// complete, right before it replaces the file. The file is left untouched if
+// commit fails.
+func replaceAtomic(path string, perm os.FileMode, write func(io.Writer) error, commit func() error) error {
+	// The extension is kept for tools guessing the format from it.
+	base, ext := filepath.Base(path), filepath.Ext(path)
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+strings.TrimSuffix(base, ext)+".*"+ext)
 	if err != nil {
-		return fmt.Errorf("could not open file at path %q: %w", path, err)
+		return fmt.Errorf("could not create temporary file for path %q: %w", path, err)
 	}
-	defer file.Close()
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	defer tmp.Close()
 
-	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
-		return fmt.Errorf("could not acquire exclusive lock on file at path %q: %w", path, err)
+	if err := write(tmp); err != nil {
+		return fmt.Errorf("could not write file at path %q: %w", path, err)
 	}
-	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN) //nolint:errcheck
 
-	var data T
-	if err := json.NewDecoder(file).Decode(&data); err != nil {
-		return fmt.Errorf("could not decode data in file at path %q: %w", path, err)
+	if err := tmp.Chmod(perm); err != nil {
+		return fmt.Errorf("could not set permissions of file at path %q: %w", path, err)
 	}
 
-	replace, err := f(data)
-	if err != nil {
-		return err
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("could not sync file at path %q: %w", path, err)
 	}
 
-	if err := file.Truncate(0); err != nil {
-		return fmt.Errorf("could not truncate file at path %q: %w", path, err)
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not close file at path %q: %w", path, err)
 	}
 
-	if _, err := file.Seek(0, 0); err != nil {
-		return fmt.Errorf("could not seek to beginning of file at path %q: %w", path, err)
+	if err := commit(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not replace file at path %q: %w", path, err)
 	}
 
-	return json.NewEncoder(file).Encode(replace)
+	return nil
 }
@@ -1,16 +1,25 @@
 package mkcdj_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
+	"math"
 	"mkcdj"
+	"mkcdj/quality"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPresets(t *testing.T) {
@@ -37,81 +46,2290 @@ func TestPresets(t *testing.T) {
 		assert(t, true, err != nil)
 		assert(t, "default", p.Name)
 	})
+
+	t.Run("it should list the presets sorted by minimum BPM", func(t *testing.T) {
+		out := bytes.NewBuffer(nil)
+		noerr(t, mkcdj.ListPresets(out, mkcdj.Presets))
+		assert(t, true, strings.HasPrefix(out.String(), "default [40-220]\nhiphop [60-115]\ndub [60-90]\n"))
+	})
+
+	t.Run("it should export the preset table as JSON", func(t *testing.T) {
+		out := bytes.NewBuffer(nil)
+		noerr(t, mkcdj.WritePresetsJSON(out, mkcdj.Presets))
+		assert(t, true, strings.HasPrefix(out.String(), `[{"name":"default","min":40,"max":220},`))
+	})
+}
+
+func TestCustomPresets(t *testing.T) {
+	t.Run("it should load presets from JSON or CSV", func(t *testing.T) {
+		for _, data := range []string{
+			`[{"name":"all","min":1,"max":300},{"name":"edits","min":95,"max":105}]`,
+			"all,1,300\nedits,95,105\n",
+		} {
+			presets, err := mkcdj.LoadPresets(strings.NewReader(data))
+			noerr(t, err)
+			assert(t, 2, len(presets))
+			assert(t, "edits", presets[1].Name)
+			assert(t, 105, presets[1].Max)
+		}
+	})
+
+	t.Run("it should reject empty tables and invalid ranges", func(t *testing.T) {
+		for _, data := range []string{"[]", "", "foo,10,5\n"} {
+			_, err := mkcdj.LoadPresets(strings.NewReader(data))
+			assert(t, true, err != nil)
+		}
+	})
+
+	t.Run("it should use the configured presets", func(t *testing.T) {
+		presets := []mkcdj.Preset{{Name: "all", Min: 1, Max: 300}, {Name: "edits", Min: 95, Max: 105}}
+
+		_, params := setup(t)
+
+		SUT := mkcdj.New(mkcdj.WithRepository(params.PlaylistFilePath), mkcdj.WithPresets(presets))
+
+		p, err := SUT.PresetFromBPM(100)
+		noerr(t, err)
+		assert(t, "edits", p.Name)
+
+		_, err = SUT.PresetFromName("dnb")
+		assert(t, true, err != nil)
+
+		// The stored tracks use the built-in default preset, missing from the table.
+		out := bytes.NewBuffer(nil)
+		noerr(t, SUT.List(out))
+		assert(t, true, strings.Contains(out.String(), "[default]"))
+	})
+
+	t.Run("it should keep stored presets missing from the table", func(t *testing.T) {
+		presets := []mkcdj.Preset{{Name: "all", Min: 1, Max: 300}}
+
+		_, params := setup(t)
+
+		tracks := loadPlaylist(t, params.PlaylistFilePath)
+		tracks = append(tracks, mkcdj.Track{Path: "/tmp/vinyl.flac", Hash: "vinyl", BPM: 100, Preset: mkcdj.Preset{Name: "vinyl"}})
+		payload, err := json.Marshal(tracks)
+		noerr(t, err)
+		noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+		SUT := mkcdj.New(mkcdj.WithRepository(params.PlaylistFilePath), mkcdj.WithPresets(presets))
+
+		var found []mkcdj.Track
+		noerr(t, SUT.Find(io.Discard, func(t mkcdj.Track) bool { found = append(found, t); return true }))
+		assert(t, 2, len(found))
+		assert(t, mkcdj.Presets[0], found[0].Preset)
+		assert(t, mkcdj.Preset{Name: "vinyl", Min: 1, Max: 300}, found[1].Preset)
+
+		n, err := SUT.Rebase("/tmp", "/mnt")
+		noerr(t, err)
+		assert(t, true, n > 0)
+
+		tracks = loadPlaylist(t, params.PlaylistFilePath)
+		assert(t, "default", tracks[0].Preset.Name)
+		assert(t, "vinyl", tracks[1].Preset.Name)
+	})
+
+	t.Run("it should break ties between ranges of the same width deterministically", func(t *testing.T) {
+		presets := []mkcdj.Preset{
+			{Name: "all", Min: 1, Max: 300},
+			{Name: "zeta", Min: 100, Max: 110},
+			{Name: "alpha", Min: 105, Max: 115},
+		}
+
+		_, params := setup(t)
+
+		SUT := mkcdj.New(mkcdj.WithRepository(params.PlaylistFilePath), mkcdj.WithPresets(presets))
+
+		for _, test := range []struct {
+			bpm  float64
+			want string
+		}{
+			{106, "zeta"},    // Closest center.
+			{114, "alpha"},   // Closest center.
+			{107.5, "alpha"}, // Same distance, alphabetical order.
+		} {
+			p, err := SUT.PresetFromBPM(test.bpm)
+			noerr(t, err)
+			assert(t, test.want, p.Name)
+		}
+	})
+}
+
+func TestRegisterPreset(t *testing.T) {
+	defer func(saved []mkcdj.Preset) { mkcdj.Presets = saved }(mkcdj.Presets)
+
+	noerr(t, mkcdj.RegisterPreset(mkcdj.Preset{Name: "edits", Min: 98, Max: 102}))
+
+	p, err := mkcdj.PresetFromBPM(100)
+	noerr(t, err)
+	assert(t, "edits", p.Name)
+
+	p, err = mkcdj.PresetFromName("edits")
+	noerr(t, err)
+	assert(t, 102, p.Max)
+
+	assert(t, "default", mkcdj.Presets[0].Name)
+
+	for _, p := range []mkcdj.Preset{
+		{Name: "edits", Min: 90, Max: 95},
+		{Name: "auto", Min: 90, Max: 95},
+		{Name: "", Min: 90, Max: 95},
+		{Name: "slow", Min: 95, Max: 90},
+	} {
+		assert(t, true, mkcdj.RegisterPreset(p) != nil)
+	}
+}
+
+func TestValidatePresets(t *testing.T) {
+	t.Run("it should report the overlaps of the built-in table", func(t *testing.T) {
+		var got []string
+		for _, w := range mkcdj.ValidatePresets(mkcdj.Presets) {
+			got = append(got, w.String())
+		}
+		assert(t, "[overlap] 60.00-89.99 hiphop dub,[overlap] 128.00-129.99 house techno", strings.Join(got, ","))
+	})
+
+	t.Run("it should report inverted ranges and gaps", func(t *testing.T) {
+		warnings := mkcdj.ValidatePresets([]mkcdj.Preset{
+			{Name: "all", Min: 1, Max: 300},
+			{Name: "slow", Min: 60, Max: 99.99},
+			{Name: "mid", Min: 100, Max: 119.99},
+			{Name: "fast", Min: 125, Max: 140},
+			{Name: "broken", Min: 150, Max: 145},
+		})
+
+		assert(t, 2, len(warnings))
+		assert(t, "[inverted] 150.00-145.00 broken", warnings[0].String())
+		assert(t, "[gap] 119.99-125.00 mid fast", warnings[1].String())
+	})
+}
+
+func TestSerialization(t *testing.T) {
+	t.Run("it should unserialize and serialize a playlist", func(t *testing.T) {
+		data := `[{"path":"/foo","hash":"bar","preset":"dnb","bpm":100}]`
+
+		var tracks []mkcdj.Track
+		noerr(t, json.Unmarshal([]byte(data), &tracks))
+		assert(t, "/foo", tracks[0].Path)
+		assert(t, "bar", tracks[0].Hash)
+		assert(t, "dnb", tracks[0].Preset.Name)
+		assert(t, 100, tracks[0].BPM)
+
+		got, err := json.Marshal(&tracks)
+		noerr(t, err)
+		assert(t, data, string(got))
+	})
+
+	t.Run("it should use the default preset if the track preset is empty", func(t *testing.T) {
+		data := `[{"path":"/foo","hash":"bar","preset":"","bpm":100}]`
+
+		var tracks []mkcdj.Track
+		noerr(t, json.Unmarshal([]byte(data), &tracks))
+		assert(t, "default", tracks[0].Preset.Name)
+	})
+}
+
+func TestAnalyze(t *testing.T) {
+	SUT, params := setup(t)
+
+	// Do the analysis twice to check duplication.
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, 1, len(tracks))
+	assert(t, params.SourceFilePath, tracks[0].Path)
+	assert(t, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", tracks[0].Hash)
+	assert(t, 100, tracks[0].BPM)
+}
+
+func TestEmptyRepository(t *testing.T) {
+	_, params := setup(t)
+
+	for _, create := range [...]bool{true, false} {
+		store := filepath.Join(t.TempDir(), "mkcdj.json")
+		if create {
+			noerr(t, os.WriteFile(store, nil, 0666))
+		}
+
+		SUT := mkcdj.New(
+			mkcdj.WithRepository(store),
+			mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+			mkcdj.WithBPMScanFunc(stubBPMScanner),
+		)
+
+		noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+		assert(t, 1, len(loadPlaylist(t, store)))
+	}
+}
+
+func TestInspect(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(func(r io.Reader, min, max float64) (float64, error) {
+			return 120, nil
+		}),
+	)
+
+	track, err := SUT.Inspect(context.Background(), params.SourceFilePath, mkcdj.Presets[0])
+	noerr(t, err)
+
+	assert(t, 120, track.BPM)
+	assert(t, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", track.Hash)
+	assert(t, 100, loadPlaylist(t, params.PlaylistFilePath)[0].BPM)
+}
+
+func TestAnalyzeReader(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(func(r io.Reader, min, max float64) (float64, error) {
+			return 120, nil
+		}),
+	)
+
+	noerr(t, SUT.AnalyzeReader(context.Background(), strings.NewReader("world\n"), "stream", mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	assert(t, 2, len(tracks))
+
+	i := slices.IndexFunc(tracks, func(t mkcdj.Track) bool { return t.Path == "stream" })
+	assert(t, true, i >= 0)
+	assert(t, 120, tracks[i].BPM)
+	assert(t, "e258d248fda94c63753607f7c4494ee0fcbe92f1a76bfdac795c9d84101eb317", tracks[i].Hash)
+}
+
+func TestAnalyzeAuto(t *testing.T) {
+	_, params := setup(t)
+
+	var scanned [2]float64
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(func(r io.Reader, min, max float64) (float64, error) {
+			scanned = [2]float64{min, max}
+			return 172, nil
+		}),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Auto))
+
+	assert(t, [2]float64{mkcdj.Presets[0].Min, mkcdj.Presets[0].Max}, scanned)
+	assert(t, "dnb", loadPlaylist(t, params.PlaylistFilePath)[0].Preset.Name)
+}
+
+func TestAnalyzeDir(t *testing.T) {
+	_, params := setup(t)
+
+	dir := t.TempDir()
+	noerr(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	noerr(t, os.WriteFile(filepath.Join(dir, "a.wav"), []byte("a"), 0666))
+	noerr(t, os.WriteFile(filepath.Join(dir, "sub", "b.MP3"), []byte("b"), 0666))
+	noerr(t, os.WriteFile(filepath.Join(dir, "cover.jpg"), []byte("c"), 0666))
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+	)
+
+	noerr(t, SUT.AnalyzeDir(context.Background(), dir, mkcdj.Presets[0]))
+
+	assert(t, 3, len(loadPlaylist(t, params.PlaylistFilePath)))
+}
+
+func TestAnalyzeDirResume(t *testing.T) {
+	_, params := setup(t)
+
+	dir := t.TempDir()
+	for i := 0; i < 40; i++ {
+		noerr(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%02d.wav", i)), []byte(fmt.Sprint(i)), 0666))
+	}
+
+	var mu sync.Mutex
+	var n int
+
+	analyze := func(fail string, opts ...mkcdj.Option) error {
+		n = 0
+		SUT := mkcdj.New(append([]mkcdj.Option{
+			mkcdj.WithRepository(params.PlaylistFilePath),
+			mkcdj.WithPipeline(mkcdj.Analyze, mkcdj.PipelineFunc(func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+				content, err := io.ReadAll(stdin)
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				n++
+				if string(content) == fail {
+					return errors.New("interrupted")
+				}
+				return writeOk.Run(ctx, stdin, stdout, stderr)
+			})),
+			mkcdj.WithBPMScanFunc(stubBPMScanner),
+		}, opts...)...)
+		return SUT.AnalyzeDir(context.Background(), dir, mkcdj.Presets[0])
+	}
+
+	// The first checkpoint is saved, the failing one is not.
+	assert(t, true, analyze("35", mkcdj.WithFailFast()) != nil)
+	assert(t, 33, len(loadPlaylist(t, params.PlaylistFilePath)))
+
+	noerr(t, analyze(""))
+	assert(t, 8, n)
+	assert(t, 41, len(loadPlaylist(t, params.PlaylistFilePath)))
+
+	noerr(t, analyze(""))
+	assert(t, 0, n)
+
+	later := time.Now().Add(time.Hour)
+	noerr(t, os.Chtimes(filepath.Join(dir, "07.wav"), later, later))
+
+	noerr(t, analyze(""))
+	assert(t, 1, n)
+}
+
+func TestAnalyzeAll(t *testing.T) {
+	SUT, params := setup(t)
+
+	dir := t.TempDir()
+	a, b, c := filepath.Join(dir, "a.wav"), filepath.Join(dir, "b.wav"), filepath.Join(dir, "c.wav")
+	noerr(t, os.WriteFile(a, []byte("a"), 0666))
+	noerr(t, os.WriteFile(b, []byte("b"), 0666))
+	noerr(t, os.WriteFile(c, []byte("a"), 0666))
+
+	paths := []string{a, b, c, params.SourceFilePath, filepath.Join(dir, "missing.wav")}
+
+	assert(t, true, SUT.AnalyzeAll(context.Background(), paths, mkcdj.Presets[0]) != nil)
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	assert(t, 3, len(tracks))
+
+	hashes := make(map[string]bool)
+	for _, t := range tracks {
+		hashes[t.Hash] = true
+	}
+	assert(t, 3, len(hashes))
+}
+
+func TestRefresh(t *testing.T) {
+	SUT, params := setup(t)
+
+	noerr(t, SUT.Refresh(context.Background()))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, 1, len(tracks))
+	assert(t, params.SourceFilePath, tracks[0].Path)
+	assert(t, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", tracks[0].Hash)
+	assert(t, 100, tracks[0].BPM)
+}
+
+func TestProgress(t *testing.T) {
+	_, params := setup(t)
+
+	var calls []string
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithProgress(func(done, total int, t mkcdj.Track) {
+			calls = append(calls, fmt.Sprintf("%d/%d %s", done, total, t.Path))
+		}),
+	)
+
+	noerr(t, SUT.Refresh(context.Background()))
+
+	assert(t, 1, len(calls))
+	assert(t, "1/1 "+params.SourceFilePath, calls[0])
+}
+
+func TestRefreshErrors(t *testing.T) {
+	SUT, params := setup(t)
+
+	missing := filepath.Join(t.TempDir(), "missing.flac")
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	tracks = append(tracks, mkcdj.Track{Path: missing, Hash: "missing", BPM: 90, Preset: mkcdj.Presets[0]})
+	tracks[0].BPM = 80
+	payload, err := json.Marshal(tracks)
+	noerr(t, err)
+	noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+	err = SUT.Refresh(context.Background())
+	assert(t, true, err != nil && strings.Contains(err.Error(), missing))
+
+	tracks = loadPlaylist(t, params.PlaylistFilePath)
+	assert(t, 2, len(tracks))
+	for _, track := range tracks {
+		switch track.Path {
+		case missing:
+			assert(t, 90, track.BPM)
+		default:
+			assert(t, 100, track.BPM)
+		}
+	}
+}
+
+func TestRefreshCanceled(t *testing.T) {
+	SUT, params := setup(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := SUT.Refresh(ctx)
+	assert(t, context.Canceled, err)
+	assert(t, 1, len(loadPlaylist(t, params.PlaylistFilePath)))
+}
+
+func TestDeadline(t *testing.T) {
+	_, params := setup(t)
+
+	slow := filepath.Join(t.TempDir(), "slow.flac")
+	noerr(t, os.WriteFile(slow, []byte("slow\n"), 0666))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	tracks = append(tracks, mkcdj.Track{Path: slow, Hash: "slow", BPM: 90, Preset: mkcdj.Presets[0]})
+	tracks[0].BPM = 80
+	payload, err := json.Marshal(tracks)
+	noerr(t, err)
+	noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, mkcdj.PipelineFunc(func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+			data, err := io.ReadAll(stdin)
+			if err != nil {
+				return err
+			}
+			if string(data) == "slow\n" {
+				return block(ctx, stdin, stdout, stderr)
+			}
+			return stubCmd(ctx, stdin, stdout, stderr)
+		})),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithConcurrency(2),
+		mkcdj.WithDeadline(100*time.Millisecond),
+	)
+
+	assert(t, context.DeadlineExceeded, SUT.Refresh(context.Background()))
+
+	for _, track := range loadPlaylist(t, params.PlaylistFilePath) {
+		switch track.Path {
+		case slow:
+			assert(t, 90, track.BPM)
+		default:
+			assert(t, 100, track.BPM)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	SUT, params := setup(t)
+
+	dir, err := SUT.Compile(context.Background(), params.OutDirPath)
+	noerr(t, err)
+	assert(t, params.OutDirPath, filepath.Dir(dir))
+
+	files := listFiles(t, params.OutDirPath)
+
+	t.Log(files)
+
+	base, ext := filepath.Base(params.SourceFilePath), filepath.Ext(params.SourceFilePath)
+
+	want := fmt.Sprintf("100 - %s", base[:len(base)-len(ext)])
+
+	assert(t, 3, len(files))
+	assert(t, want+".wav", filepath.Base(files[0]))
+	assert(t, "default", filepath.Base(filepath.Dir(files[0])))
+
+	checkFile(t, params.OutDirPath, filepath.Dir(files[0]), want+".wav")
+	checkFile(t, params.OutDirPath, filepath.Dir(files[1]), want+".png")
+	checkFile(t, params.OutDirPath, filepath.Dir(files[2]), want+".png")
+}
+
+func TestCompileMissing(t *testing.T) {
+	SUT, params := setup(t)
+
+	lost := filepath.Join(t.TempDir(), "lost.flac")
+	noerr(t, os.WriteFile(lost, []byte("lost\n"), 0666))
+	noerr(t, SUT.Analyze(context.Background(), lost, mkcdj.Presets[0]))
+	noerr(t, os.Remove(lost))
+
+	logs := bytes.NewBuffer(nil)
+
+	SUT = mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+		mkcdj.WithLogger(slog.New(slog.NewJSONHandler(logs, nil))),
+	)
+
+	_, err := SUT.Compile(context.Background(), params.OutDirPath)
+	noerr(t, err)
+
+	assert(t, 3, len(listFiles(t, params.OutDirPath)))
+
+	var skipped []string
+
+	dec := json.NewDecoder(logs)
+	for dec.More() {
+		var event struct {
+			Level string
+			Msg   string
+			Track struct{ Path string }
+		}
+		noerr(t, dec.Decode(&event))
+		if event.Msg == "skipped" {
+			assert(t, "WARN", event.Level)
+			skipped = append(skipped, event.Track.Path)
+		}
+	}
+
+	assert(t, 1, len(skipped))
+	assert(t, lost, skipped[0])
+}
+
+func TestCompileWarn(t *testing.T) {
+	SUT, params := setup(t)
+
+	lossy := filepath.Join(t.TempDir(), "lossy.mp3")
+	noerr(t, os.WriteFile(lossy, []byte("lossy\n"), 0666))
+	noerr(t, SUT.Analyze(context.Background(), lossy, mkcdj.Presets[0]))
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.ListStatus(out, "warn"))
+	assert(t, true, strings.Contains(out.String(), "lossy.mp3"))
+
+	dir, err := SUT.Compile(context.Background(), params.OutDirPath)
+	noerr(t, err)
+
+	assert(t, 6, len(listFiles(t, params.OutDirPath)))
+	checkFile(t, dir, "audio", "default", "100 - lossy.wav")
+}
+
+func TestLayout(t *testing.T) {
+	_, params := setup(t)
+
+	layout := func(t mkcdj.Track) (string, string, string) {
+		name := strings.TrimSuffix(filepath.Base(t.Path), filepath.Ext(t.Path))
+		return filepath.Join(t.Preset.Name, "100", name), name + " waveform", name + " spectrum"
+	}
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+		mkcdj.WithLayout(layout),
+	)
+
+	dir, err := SUT.Compile(context.Background(), params.OutDirPath)
+	noerr(t, err)
+
+	checkFile(t, dir, "default", "100", "mkcdj-source.wav")
+	checkFile(t, dir, "mkcdj-source waveform.png")
+	checkFile(t, dir, "mkcdj-source spectrum.png")
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.ExportM3U(out, dir))
+	assert(t, "#EXTM3U\n#EXTINF:-1,mkcdj-source\ndefault/100/mkcdj-source.wav\n", out.String())
+
+	SUT = mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithLayout(func(t mkcdj.Track) (string, string, string) { return "../audio", "wave", "spec" }),
+	)
+
+	_, err = SUT.Compile(context.Background(), params.OutDirPath)
+	assert(t, true, err != nil)
+}
+
+func TestRetries(t *testing.T) {
+	for _, test := range []struct {
+		retries int
+		fails   bool
+	}{{0, true}, {1, true}, {2, false}} {
+		_, params := setup(t)
+
+		// Fails twice, after writing part of its output.
+		var calls int
+		flaky := mkcdj.PipelineFunc(func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+			if calls++; calls <= 2 {
+				fmt.Fprint(stdout, "partial")
+				return errors.New("resource temporarily unavailable")
+			}
+			return stubCmd(ctx, stdin, stdout, stderr)
+		})
+
+		SUT := mkcdj.New(
+			mkcdj.WithRepository(params.PlaylistFilePath),
+			mkcdj.WithPipeline(mkcdj.Convert, flaky),
+			mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+			mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+			mkcdj.WithRetries(test.retries, time.Millisecond),
+		)
+
+		dir, err := SUT.Compile(context.Background(), params.OutDirPath)
+		assert(t, test.fails, err != nil)
+		if !test.fails {
+			checkFile(t, dir, "audio", "default", "100 - mkcdj-source.wav")
+		}
+	}
+}
+
+func TestPartialOutput(t *testing.T) {
+	_, params := setup(t)
+
+	fail := mkcdj.PipelineFunc(func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+		fmt.Fprint(stdout, "partial")
+		return errors.New("interrupted")
+	})
+
+	compile := func(p mkcdj.Pipeline) (string, error) {
+		return mkcdj.New(
+			mkcdj.WithRepository(params.PlaylistFilePath),
+			mkcdj.WithPipeline(mkcdj.Convert, p),
+			mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+			mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+			mkcdj.WithOutputDir("out"),
+			mkcdj.WithOverwritePolicy(mkcdj.SkipExisting),
+		).Compile(context.Background(), params.OutDirPath)
+	}
+
+	dir, err := compile(fail)
+	assert(t, true, err != nil)
+
+	entries, err := os.ReadDir(filepath.Join(dir, "audio", "default"))
+	noerr(t, err)
+	assert(t, 0, len(entries))
+
+	// The next compilation converts the track again despite the skip policy.
+	dir, err = compile(writeOk)
+	noerr(t, err)
+	checkFile(t, dir, "audio", "default", "100 - mkcdj-source.wav")
+}
+
+func TestRetriesCanceled(t *testing.T) {
+	_, params := setup(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var calls int
+	fail := mkcdj.PipelineFunc(func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+		calls++
+		cancel()
+		return errors.New("resource temporarily unavailable")
+	})
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, fail),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+		mkcdj.WithRetries(5, time.Hour),
+	)
+
+	_, err := SUT.Compile(ctx, params.OutDirPath)
+	assert(t, true, err != nil)
+	assert(t, 1, calls)
+}
+
+func TestContactSheet(t *testing.T) {
+	_, params := setup(t)
+
+	dnb, err := mkcdj.PresetFromName("dnb")
+	noerr(t, err)
+
+	other := filepath.Join(t.TempDir(), "other.flac")
+	noerr(t, os.WriteFile(other, []byte("other"), 0666))
+
+	tracks := append(loadPlaylist(t, params.PlaylistFilePath),
+		mkcdj.Track{Path: other, Hash: "other", BPM: 170, Preset: dnb},
+		mkcdj.Track{Path: filepath.Join(t.TempDir(), "lost.flac"), Hash: "lost", BPM: 172, Preset: dnb},
+	)
+	payload, err := json.Marshal(tracks)
+	noerr(t, err)
+	noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+	montage := func(ctx context.Context, paths []string, out, err io.Writer) error {
+		for _, p := range paths {
+			fmt.Fprintln(out, filepath.Base(p))
+		}
+		return nil
+	}
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+		mkcdj.WithMontageFunc(montage),
+		mkcdj.WithContactSheet(),
+	)
+
+	dir, err := SUT.Compile(context.Background(), params.OutDirPath)
+	noerr(t, err)
+
+	for _, test := range []struct{ preset, want string }{
+		{"default", "100 - mkcdj-source.png\n"},
+		{"dnb", "170 - other.png\n"},
+	} {
+		content, err := os.ReadFile(filepath.Join(dir, "waveforms", test.preset, "contactsheet.png"))
+		noerr(t, err)
+		assert(t, test.want, string(content))
+	}
+
+	// A failed montage keeps the previous contact sheet.
+	SUT = mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+		mkcdj.WithOutputDir(filepath.Base(dir)),
+		mkcdj.WithOverwritePolicy(mkcdj.OverwriteExisting),
+		mkcdj.WithMontageFunc(func(ctx context.Context, paths []string, out, err io.Writer) error {
+			fmt.Fprint(out, "partial")
+			return errors.New("interrupted")
+		}),
+		mkcdj.WithContactSheet(),
+	)
+
+	_, err = SUT.Compile(context.Background(), params.OutDirPath)
+	assert(t, true, err != nil)
+
+	content, err := os.ReadFile(filepath.Join(dir, "waveforms", "dnb", "contactsheet.png"))
+	noerr(t, err)
+	assert(t, "170 - other.png\n", string(content))
+
+	SUT = mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+		mkcdj.WithContactSheet(),
+	)
+
+	_, err = SUT.Compile(context.Background(), params.OutDirPath)
+	assert(t, true, err != nil)
+}
+
+func TestConcurrency(t *testing.T) {
+	_, params := setup(t)
+
+	// Zero workers must not hang, as with runtime.NumCPU()/3 on small machines.
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+		mkcdj.WithConcurrency(0),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	op := SUT.CompileAsync(ctx, params.OutDirPath)
+
+	select {
+	case <-op.Done():
+		noerr(t, op.Err())
+	case <-ctx.Done():
+		t.Fatal("compile did not complete")
+	}
+
+	assert(t, 3, len(listFiles(t, params.OutDirPath)))
+}
+
+func TestOverwritePolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy mkcdj.OverwritePolicy
+		fails  bool
+	}{{mkcdj.FailExisting, true}, {mkcdj.SkipExisting, false}, {mkcdj.OverwriteExisting, false}} {
+		_, params := setup(t)
+
+		// Same preset, BPM, name and hash prefix: the last two tracks compile to
+		// the same paths despite the collision suffix.
+		tracks := loadPlaylist(t, params.PlaylistFilePath)
+		for _, hash := range [...]string{"5891b5b5-a", "5891b5b5-b"} {
+			other := filepath.Join(t.TempDir(), filepath.Base(params.SourceFilePath))
+			noerr(t, os.WriteFile(other, []byte(hash), 0666))
+			tracks = append(tracks, mkcdj.Track{Path: other, Hash: hash, BPM: 100, Preset: mkcdj.Presets[0]})
+		}
+		payload, err := json.Marshal(tracks)
+		noerr(t, err)
+		noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+		SUT := mkcdj.New(
+			mkcdj.WithRepository(params.PlaylistFilePath),
+			mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+			mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+			mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+			mkcdj.WithOverwritePolicy(test.policy),
+		)
+
+		_, err = SUT.Compile(context.Background(), params.OutDirPath)
+		assert(t, test.fails, err != nil)
+		if !test.fails {
+			assert(t, 6, len(listFiles(t, params.OutDirPath)))
+		}
+	}
+}
+
+func TestPipelineStderr(t *testing.T) {
+	_, params := setup(t)
+
+	fail := mkcdj.PipelineFunc(func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+		fmt.Fprint(stderr, "banner\n\n1\n2\n3\n4\n  Invalid data found  \n")
+		return errors.New("exit status 1")
+	})
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, fail),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+	)
+
+	_, err := SUT.Compile(context.Background(), params.OutDirPath)
+	assert(t, true, err != nil && strings.HasSuffix(err.Error(), "exit status 1: 1; 2; 3; 4; Invalid data found"))
+}
+
+func TestOutputDir(t *testing.T) {
+	_, params := setup(t)
+
+	compile := func(opts ...mkcdj.Option) error {
+		SUT := mkcdj.New(append([]mkcdj.Option{
+			mkcdj.WithRepository(params.PlaylistFilePath),
+			mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+			mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+			mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+		}, opts...)...)
+		_, err := SUT.Compile(context.Background(), params.OutDirPath)
+		return err
+	}
+
+	noerr(t, compile(mkcdj.WithOutputDir("mkcdj-set")))
+	checkFile(t, filepath.Join(params.OutDirPath, "mkcdj-set", "audio", "default", "100 - mkcdj-source.wav"))
+
+	assert(t, true, compile(mkcdj.WithOutputDir("mkcdj-set"), mkcdj.WithRebuild()) != nil)
+	noerr(t, compile(mkcdj.WithOutputDir("mkcdj-set"), mkcdj.WithRebuild(), mkcdj.WithOverwritePolicy(mkcdj.SkipExisting)))
+	assert(t, 3, len(listFiles(t, params.OutDirPath)))
+
+	noerr(t, compile(mkcdj.WithOutputDir("mkcdj-*")))
+	noerr(t, compile(mkcdj.WithOutputDir("mkcdj-*")))
+	assert(t, 9, len(listFiles(t, params.OutDirPath)))
+}
+
+func TestIncremental(t *testing.T) {
+	_, params := setup(t)
+
+	var mu sync.Mutex
+	var n int
+
+	count := mkcdj.PipelineFunc(func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		return writeOk.Run(ctx, stdin, stdout, stderr)
+	})
+
+	compile := func(opts ...mkcdj.Option) {
+		SUT := mkcdj.New(append([]mkcdj.Option{
+			mkcdj.WithRepository(params.PlaylistFilePath),
+			mkcdj.WithPipeline(mkcdj.Convert, count),
+			mkcdj.WithPipeline(mkcdj.Waveform, count),
+			mkcdj.WithPipeline(mkcdj.Spectrum, count),
+			mkcdj.WithOutputDir("mkcdj-set"),
+			mkcdj.WithOverwritePolicy(mkcdj.OverwriteExisting),
+		}, opts...)...)
+		_, err := SUT.Compile(context.Background(), params.OutDirPath)
+		noerr(t, err)
+	}
+
+	compile()
+	assert(t, 3, n)
+
+	compile()
+	assert(t, 3, n)
+
+	noerr(t, os.Remove(filepath.Join(params.OutDirPath, "mkcdj-set", "waveforms", "default", "100 - mkcdj-source.png")))
+
+	compile()
+	assert(t, 6, n)
+
+	compile(mkcdj.WithRebuild())
+	assert(t, 9, n)
+}
+
+func TestCollisions(t *testing.T) {
+	SUT, params := setup(t)
+
+	other := filepath.Join(t.TempDir(), filepath.Base(params.SourceFilePath))
+	noerr(t, os.WriteFile(other, []byte("world\n"), 0666))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	tracks = append(tracks, mkcdj.Track{Path: other, Hash: "0123456789", BPM: 100, Preset: mkcdj.Presets[0]})
+	payload, err := json.Marshal(tracks)
+	noerr(t, err)
+	noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+	_, err = SUT.Compile(context.Background(), params.OutDirPath)
+	noerr(t, err)
+
+	files := listFiles(t, params.OutDirPath)
+	assert(t, 6, len(files))
+	assert(t, true, slices.ContainsFunc(files, func(f string) bool {
+		return strings.HasSuffix(f, "audio/default/100 - mkcdj-source [01234567].wav")
+	}))
+}
+
+func TestDeduplication(t *testing.T) {
+	_, params := setup(t)
+
+	dir := t.TempDir()
+	copied, other := filepath.Join(dir, "copy.flac"), filepath.Join(dir, "other.flac")
+	noerr(t, os.WriteFile(copied, []byte("hello\n"), 0666))
+	noerr(t, os.WriteFile(other, []byte("world\n"), 0666))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	tracks = append(tracks,
+		mkcdj.Track{Path: copied, Hash: tracks[0].Hash, BPM: 100, Preset: mkcdj.Presets[0]},
+		mkcdj.Track{Path: other, Hash: "0123456789", BPM: 100, Preset: mkcdj.Presets[0]},
+	)
+	payload, err := json.Marshal(tracks)
+	noerr(t, err)
+	noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+		mkcdj.WithDeduplication(),
+	)
+
+	out, err := SUT.Compile(context.Background(), params.OutDirPath)
+	noerr(t, err)
+
+	stat := func(name string) os.FileInfo {
+		t.Helper()
+		fi, err := os.Stat(filepath.Join(out, "audio", "default", name))
+		noerr(t, err)
+		return fi
+	}
+
+	source := stat("100 - mkcdj-source.wav")
+
+	assert(t, true, os.SameFile(source, stat("100 - copy.wav")))
+	assert(t, false, os.SameFile(source, stat("100 - other.wav")))
+}
+
+func TestLayoutCollisions(t *testing.T) {
+	_, params := setup(t)
+
+	other := filepath.Join(t.TempDir(), filepath.Base(params.SourceFilePath))
+	noerr(t, os.WriteFile(other, []byte("world\n"), 0666))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	tracks = append(tracks, mkcdj.Track{Path: other, Hash: "0123456789", BPM: 110, Preset: mkcdj.Presets[0]})
+	payload, err := json.Marshal(tracks)
+	noerr(t, err)
+	noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+	// Audio files are distinct but images only depend on the file name.
+	layout := func(t mkcdj.Track) (string, string, string) {
+		name := strings.TrimSuffix(filepath.Base(t.Path), filepath.Ext(t.Path))
+		return fmt.Sprintf("%.0f - %s", t.BPM, name), name + " waveform", name + " spectrum"
+	}
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+		mkcdj.WithLayout(layout),
+	)
+
+	dir, err := SUT.Compile(context.Background(), params.OutDirPath)
+	noerr(t, err)
+
+	checkFile(t, dir, "100 - mkcdj-source.wav")
+	checkFile(t, dir, "mkcdj-source waveform.png")
+	checkFile(t, dir, "110 - mkcdj-source [01234567].wav")
+	checkFile(t, dir, "mkcdj-source waveform [01234567].png")
+	checkFile(t, dir, "mkcdj-source spectrum [01234567].png")
+}
+
+func TestPrecision(t *testing.T) {
+	for _, test := range []struct {
+		precision int
+		want      float64
+	}{{2, 117.99}, {0, 118}, {-1, 117.98765}} {
+		_, params := setup(t)
+
+		SUT := mkcdj.New(
+			mkcdj.WithRepository(params.PlaylistFilePath),
+			mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+			mkcdj.WithBPMScanFunc(func(r io.Reader, min, max float64) (float64, error) {
+				return 117.98765, nil
+			}),
+			mkcdj.WithPrecision(test.precision),
+		)
+
+		noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+		assert(t, test.want, loadPlaylist(t, params.PlaylistFilePath)[0].BPM)
+	}
+}
+
+func TestQuality(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithQualityScanFunc(func(ctx context.Context, path string) (float64, error) {
+			return 0.01, nil
+		}),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, 0.01, tracks[0].Quality)
+	assert(t, true, strings.Contains(tracks[0].String(), "[lo]"))
+}
+
+func TestQualityZero(t *testing.T) {
+	_, params := setup(t)
+
+	// Nothing above 20kHz: the lossy case the score is meant to catch.
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithQualityScanFunc(func(ctx context.Context, path string) (float64, error) {
+			return 0, nil
+		}),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, true, tracks[0].Scored)
+	assert(t, true, strings.Contains(tracks[0].String(), "[lo]"))
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.ExportCSV(out))
+	assert(t, true, strings.HasSuffix(out.String(), ",0.0000\n"))
+}
+
+func TestQualityFailure(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithQualityScanFunc(func(ctx context.Context, path string) (float64, error) {
+			return 0, errors.New("sox FAIL formats: no handler for file extension")
+		}),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, 100.0, tracks[0].BPM)
+	assert(t, true, strings.Contains(tracks[0].String(), "[flac] [--]"))
+}
+
+func TestRequality(t *testing.T) {
+	SUT, params := setup(t)
+
+	assert(t, true, SUT.Requality(context.Background()) != nil)
+
+	SUT = mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, block),
+		mkcdj.WithBPMScanFunc(func(r io.Reader, min, max float64) (float64, error) {
+			return 0, errors.New("analyzed")
+		}),
+		mkcdj.WithQualityScanFunc(func(ctx context.Context, path string) (float64, error) {
+			return 0.01, nil
+		}),
+	)
+
+	noerr(t, SUT.Requality(context.Background()))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, 100.0, tracks[0].BPM)
+	assert(t, 0.01, tracks[0].Quality)
+	assert(t, true, tracks[0].Scored)
+}
+
+func TestSecondaryFailures(t *testing.T) {
+	_, params := setup(t)
+
+	fail := func(ctx context.Context, path string) (float64, error) {
+		return 0, errors.New("ffprobe FAIL")
+	}
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithLoudnessScanFunc(fail),
+		mkcdj.WithCodecProbeFunc(func(ctx context.Context, path string) (string, error) {
+			return "", errors.New("ffprobe FAIL")
+		}),
+		mkcdj.WithTagsProbeFunc(func(ctx context.Context, path string) (mkcdj.Tags, error) {
+			return mkcdj.Tags{}, errors.New("ffprobe FAIL")
+		}),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, 100.0, tracks[0].BPM)
+	assert(t, "", tracks[0].Codec)
+	assert(t, "", tracks[0].Artist)
+	assert(t, 0.0, tracks[0].LUFS)
+}
+
+func TestLoudness(t *testing.T) {
+	_, params := setup(t)
+
+	lufs := -14.2
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithLoudnessScanFunc(func(ctx context.Context, path string) (float64, error) {
+			return lufs, nil
+		}),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, -14.2, tracks[0].LUFS)
+	assert(t, true, strings.Contains(tracks[0].String(), "[--] [-14] mkcdj-source.flac"))
+
+	lufs = -9
+	noerr(t, SUT.Refresh(context.Background()))
+
+	assert(t, -9.0, loadPlaylist(t, params.PlaylistFilePath)[0].LUFS)
+}
+
+func TestTempoFolding(t *testing.T) {
+	_, params := setup(t)
+
+	dnb, err := mkcdj.PresetFromName("dnb")
+	noerr(t, err)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(func(r io.Reader, min, max float64) (float64, error) {
+			return 87, nil
+		}),
+		mkcdj.WithTempoFolding(),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, dnb))
+
+	assert(t, 174, loadPlaylist(t, params.PlaylistFilePath)[0].BPM)
+}
+
+func TestDuration(t *testing.T) {
+	_, params := setup(t)
+
+	samples := make([]float32, 3*44100)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeFloats(samples...)),
+		mkcdj.WithBPMScanFunc(readAll),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, 3, tracks[0].Duration)
+	assert(t, true, strings.Contains(tracks[0].String(), "[00:03]"))
+}
+
+func TestSampleRate(t *testing.T) {
+	_, params := setup(t)
+
+	samples := make([]float32, 3*48000)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithSampleRate(48000),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeFloats(samples...)),
+		mkcdj.WithBPMScanFunc(readAll),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	assert(t, 3, loadPlaylist(t, params.PlaylistFilePath)[0].Duration)
+}
+
+func TestSampleRateScanners(t *testing.T) {
+	// A click track at 124 BPM sampled at 48kHz, read as 44100Hz, would be
+	// detected around 135 BPM.
+	const rate, tempo = 48000, 124
+
+	samples := make([]float32, 10*rate)
+	period := int(rate * 60 / tempo)
+	for i := 0; i < len(samples); i += period {
+		for j := i; j < min(i+rate/100, len(samples)); j++ {
+			samples[j] = float32(math.Sin(2 * math.Pi * 1000 * float64(j-i) / rate))
+		}
+	}
+
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithSampleRate(rate),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeFloats(samples...)),
+	)
+
+	track, err := SUT.Inspect(context.Background(), params.SourceFilePath, mkcdj.Preset{Name: "wide", Min: 100, Max: 140})
+	noerr(t, err)
+
+	if math.Abs(track.BPM-tempo) > 1 {
+		t.Errorf("want: %d±1, got: %.2f", tempo, track.BPM)
+	}
+}
+
+func TestAnalyzeAsync(t *testing.T) {
+	t.Run("it should complete the analysis in the background", func(t *testing.T) {
+		SUT, params := setup(t)
+
+		op := SUT.AnalyzeAsync(context.Background(), params.SourceFilePath, mkcdj.Presets[0])
+
+		<-op.Done()
+		noerr(t, op.Err())
+	})
+
+	t.Run("it should cancel a running analysis", func(t *testing.T) {
+		_, params := setup(t)
+
+		SUT := mkcdj.New(
+			mkcdj.WithRepository(params.PlaylistFilePath),
+			mkcdj.WithPipeline(mkcdj.Analyze, block),
+			mkcdj.WithBPMScanFunc(stubBPMScanner),
+		)
+
+		op := SUT.AnalyzeAsync(context.Background(), params.SourceFilePath, mkcdj.Presets[0])
+		op.Cancel()
+
+		assert(t, true, errors.Is(op.Err(), context.Canceled))
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, block),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithTimeout(10*time.Millisecond),
+	)
+
+	err := SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0])
+	assert(t, true, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestAtomicWrite(t *testing.T) {
+	_, params := setup(t)
+
+	dir := t.TempDir()
+	store := filepath.Join(dir, "mkcdj.json")
+	noerr(t, os.WriteFile(store, []byte("[]"), 0640))
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(store),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	entries, err := os.ReadDir(dir)
+	noerr(t, err)
+	assert(t, 2, len(entries))
+
+	info, err := os.Stat(store)
+	noerr(t, err)
+	assert(t, fs.FileMode(0640), info.Mode().Perm())
+	assert(t, 1, len(loadPlaylist(t, store)))
+}
+
+func TestLocking(t *testing.T) {
+	_, params := setup(t)
+
+	dir := t.TempDir()
+	store := filepath.Join(dir, "mkcdj.json")
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(store),
+		mkcdj.WithLocking(false),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	entries, err := os.ReadDir(dir)
+	noerr(t, err)
+	assert(t, 1, len(entries))
+}
+
+func TestBackups(t *testing.T) {
+	_, params := setup(t)
+
+	store := filepath.Join(t.TempDir(), "mkcdj.json")
+	noerr(t, os.WriteFile(store, []byte("[]"), 0666))
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(store),
+		mkcdj.WithBackups(2),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+	for _, format := range [...]string{"flac", "mp3"} {
+		mkcdj.WithFormat(format, writeOk)(SUT)
+		noerr(t, SUT.SetFormat(params.SourceFilePath, format))
+	}
+
+	// Read-only transactions don't rotate the backups.
+	for i := 0; i < 3; i++ {
+		noerr(t, SUT.List(io.Discard))
+	}
+
+	assert(t, "flac", loadPlaylist(t, store+".bak")[0].Format)
+	assert(t, "", loadPlaylist(t, store+".bak.1")[0].Format)
+
+	_, err := os.Stat(store + ".bak.2")
+	assert(t, true, errors.Is(err, fs.ErrNotExist))
+
+	assert(t, true, SUT.Restore() != nil)
+
+	noerr(t, os.WriteFile(store, []byte("{corrupted"), 0666))
+	noerr(t, SUT.Restore())
+	assert(t, 1, len(loadPlaylist(t, store)))
+}
+
+func TestStdinStore(t *testing.T) {
+	_, params := setup(t)
+
+	stdin := func() {
+		fd, err := os.Open(params.PlaylistFilePath)
+		noerr(t, err)
+		t.Cleanup(func() { fd.Close() })
+		os.Stdin = fd
+	}
+
+	defer func(saved *os.File) { os.Stdin = saved }(os.Stdin)
+
+	SUT := mkcdj.New(mkcdj.WithRepository("-"))
+
+	stdin()
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.Files(out, '\n'))
+	assert(t, params.SourceFilePath+"\n", out.String())
+
+	stdin()
+	assert(t, true, SUT.SetFormat(params.SourceFilePath, "flac") != nil)
+
+	stdin()
+	noerr(t, SUT.SetFormat(params.SourceFilePath, ""))
+
+	assert(t, true, SUT.Restore() != nil)
+}
+
+func TestStoreFormat(t *testing.T) {
+	_, params := setup(t)
+
+	store := filepath.Join(t.TempDir(), "mkcdj.gob")
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(store),
+		mkcdj.WithStoreFormat(mkcdj.Gob),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+	)
+
+	for i := 0; i < 2; i++ {
+		noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+	}
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.List(out))
+	assert(t, 1, strings.Count(out.String(), "\n"))
+
+	raw, err := os.ReadFile(store)
+	noerr(t, err)
+	assert(t, false, json.Valid(raw))
+}
+
+func BenchmarkStore(b *testing.B) {
+	tracks := make([]mkcdj.Track, 10000)
+	for i := range tracks {
+		tracks[i] = mkcdj.Track{
+			Path:   fmt.Sprintf("/music/artist %d/track %d.flac", i%100, i),
+			Hash:   fmt.Sprintf("%064x", i),
+			Preset: mkcdj.Presets[i%len(mkcdj.Presets)],
+			BPM:    100 + float64(i%80),
+		}
+	}
+
+	for _, format := range []struct {
+		name   string
+		format mkcdj.StoreFormat
+	}{{"json", mkcdj.JSON}, {"gob", mkcdj.Gob}} {
+		b.Run(format.name, func(b *testing.B) {
+			s := mkcdj.JSONFile{Path: filepath.Join(b.TempDir(), "mkcdj"), Format: format.format}
+			noerr(b, s.Update(func([]mkcdj.Track) ([]mkcdj.Track, error) { return tracks, nil }))
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				noerr(b, s.Update(func(tracks []mkcdj.Track) ([]mkcdj.Track, error) {
+					tracks[i%len(tracks)].BPM++
+					return tracks, nil
+				}))
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithStore(&memory{tracks: []mkcdj.Track{
+			{Path: params.SourceFilePath, Preset: mkcdj.Presets[5], BPM: 120},
+			{Path: "/nonexistent.flac", Preset: mkcdj.Presets[4], BPM: 130},
+			{Path: params.SourceFilePath, Preset: mkcdj.Presets[5], BPM: 125},
+		}}),
+	)
+
+	s, err := SUT.Stats()
+	noerr(t, err)
+
+	assert(t, 3, s.Tracks)
+	assert(t, 1, s.Failed)
+	assert(t, 2, s.Presets["house"])
+	assert(t, 125.0, s.AvgBPM)
+
+	want := "tracks: 3\nfailed: 1\nbpm: 120.00/125.00/130.00\npreset house: 2\npreset techno: 1\n"
+	assert(t, want, s.String())
+}
+
+func TestDuplicates(t *testing.T) {
+	_, params := setup(t)
+
+	other := filepath.Join(t.TempDir(), "mkcdj-source.flac")
+	noerr(t, os.WriteFile(other, []byte("hello\n"), 0666))
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithDuplicateWarnings(),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), other, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	assert(t, 1, len(tracks))
+	assert(t, params.SourceFilePath, tracks[0].Path)
+
+	tracks = append(tracks, tracks[0])
+	tracks[1].Path = other
+	payload, err := json.Marshal(tracks)
+	noerr(t, err)
+	noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.Duplicates(out))
+	assert(t, tracks[0].Hash+"\n  "+params.SourceFilePath+"\n  "+other+"\n", out.String())
+}
+
+func TestStore(t *testing.T) {
+	store := &memory{tracks: []mkcdj.Track{{Path: "/foo", Hash: "bar", Preset: mkcdj.Presets[0], BPM: 100}}}
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, mkcdj.New(mkcdj.WithStore(store)).List(out))
+
+	assert(t, true, strings.HasSuffix(out.String(), "foo\n"))
+}
+
+type memory struct {
+	tracks []mkcdj.Track
+}
+
+func (m *memory) Update(f func([]mkcdj.Track) ([]mkcdj.Track, error)) error {
+	tracks, err := f(m.tracks)
+	if err != nil {
+		return err
+	}
+	m.tracks = tracks
+	return nil
+}
+
+func TestScanRepeats(t *testing.T) {
+	_, params := setup(t)
+
+	var scans []float64
+
+	// The values a seeded scan would return on successive runs.
+	values := []float64{124.5, 118, 130, 124, 125}
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeFloats(1, 2, 3)),
+		mkcdj.WithBPMScanFunc(func(r io.Reader, min, max float64) (float64, error) {
+			// Each repeat reads the whole signal.
+			var data [3]float32
+			if err := binary.Read(r, binary.LittleEndian, &data); err != nil {
+				return 0, err
+			}
+			assert(t, [3]float32{1, 2, 3}, data)
+			scans = append(scans, values[len(scans)])
+			return scans[len(scans)-1], nil
+		}),
+		mkcdj.WithScanRepeats(len(values)),
+	)
+
+	noerr(t, SUT.Refresh(context.Background()))
+
+	assert(t, len(values), len(scans))
+	assert(t, 124.5, loadPlaylist(t, params.PlaylistFilePath)[0].BPM)
+}
+
+func TestScanContext(t *testing.T) {
+	_, params := setup(t)
+
+	type key struct{}
+
+	var got []any
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeFloats(1, 2, 3)),
+		mkcdj.WithBPMScanContextFunc(func(ctx context.Context, r io.Reader, min, max float64) (float64, error) {
+			got = append(got, ctx.Value(key{}))
+			return readAll(r, min, max)
+		}),
+		mkcdj.WithScanRepeats(2),
+	)
+
+	ctx := context.WithValue(context.Background(), key{}, "analysis")
+
+	noerr(t, SUT.Analyze(ctx, params.SourceFilePath, mkcdj.Presets[0]))
+
+	assert(t, 2, len(got))
+	assert(t, "analysis", got[0])
+	assert(t, "analysis", got[1])
+}
+
+func TestMultiWindow(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeFloats(100, 101, 150)),
+		mkcdj.WithBPMScanFunc(readFloat),
+		mkcdj.WithMultiWindow(3),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, 1, len(tracks))
+	assert(t, 100.5, tracks[0].BPM)
+}
+
+func TestSidecars(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithSidecars(),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	data, err := os.ReadFile(params.SourceFilePath + ".mkcdj.json")
+	noerr(t, err)
+
+	var track mkcdj.Track
+	noerr(t, json.Unmarshal(data, &track))
+	assert(t, params.SourceFilePath, track.Path)
+	assert(t, 100, track.BPM)
+}
+
+func TestEvaluate(t *testing.T) {
+	SUT, params := setup(t)
+
+	truth := fmt.Sprintf("%s,100\n%s,50,hiphop\n", params.SourceFilePath, params.SourceFilePath)
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.Evaluate(context.Background(), strings.NewReader(truth), out))
+
+	t.Log(out.String())
+
+	assert(t, true, strings.Contains(out.String(), "mean absolute error: 25.00"))
+	assert(t, true, strings.Contains(out.String(), "octave errors: 1/2 (50.0%)"))
+}
+
+func TestListJSON(t *testing.T) {
+	SUT, params := setup(t)
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.ListJSON(out))
+
+	var statuses []struct{ Status string }
+	noerr(t, json.Unmarshal(out.Bytes(), &statuses))
+	assert(t, 1, len(statuses))
+	assert(t, "good", statuses[0].Status)
+
+	var tracks []mkcdj.Track
+	noerr(t, json.Unmarshal(out.Bytes(), &tracks))
+	assert(t, 1, len(tracks))
+	assert(t, loadPlaylist(t, params.PlaylistFilePath)[0], tracks[0])
+
+	stored, err := os.ReadFile(params.PlaylistFilePath)
+	noerr(t, err)
+	assert(t, false, strings.Contains(string(stored), "status"))
+}
+
+func TestListNDJSON(t *testing.T) {
+	SUT, params := setup(t)
+
+	other := filepath.Join(t.TempDir(), "other.flac")
+	noerr(t, os.WriteFile(other, []byte("other\n"), 0666))
+	noerr(t, SUT.Analyze(context.Background(), other, mkcdj.Presets[0]))
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.ListNDJSON(out))
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert(t, 2, len(lines))
+
+	for i, line := range lines {
+		var track mkcdj.Track
+		noerr(t, json.Unmarshal([]byte(line), &track))
+		assert(t, loadPlaylist(t, params.PlaylistFilePath)[i], track)
+	}
+}
+
+func TestExportM3U(t *testing.T) {
+	SUT, _ := setup(t)
+
+	dir := t.TempDir()
+	noerr(t, os.MkdirAll(filepath.Join(dir, "default"), 0755))
+	noerr(t, os.WriteFile(filepath.Join(dir, "default", "100 - mkcdj-source.wav"), nil, 0666))
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.ExportM3U(out, dir))
+
+	want := "#EXTM3U\n#EXTINF:-1,100 - mkcdj-source\ndefault/100 - mkcdj-source.wav\n"
+	assert(t, want, out.String())
+}
+
+func TestFind(t *testing.T) {
+	SUT, _ := setup(t)
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.Find(out, func(t mkcdj.Track) bool { return t.Encoding() == "flac" }))
+	assert(t, true, strings.HasPrefix(out.String(), "[good] [default] [100] [--] [00:00] [flac] [--] [--] mkcdj-source.flac"))
+
+	out.Reset()
+	noerr(t, SUT.Find(out, func(t mkcdj.Track) bool { return t.Encoding() == "mp3" }))
+	assert(t, "", out.String())
+}
+
+func TestExportCSV(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithStore(&memory{tracks: []mkcdj.Track{
+			{Path: "/music/b, live.flac", Hash: "b", Preset: mkcdj.Presets[5], BPM: 124.6, Duration: 301.4},
+			{Path: params.SourceFilePath, Hash: "a", Preset: mkcdj.Presets[0], BPM: 99.5, Quality: 0.25},
+		}}),
+	)
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.ExportCSV(out))
+
+	want := strings.Join([]string{
+		"path,hash,preset,bpm,duration,quality",
+		params.SourceFilePath + ",a,default,100,,0.2500",
+		`"/music/b, live.flac",b,house,125,301,`,
+		"",
+	}, "\n")
+	assert(t, want, out.String())
 }
 
-func TestSerialization(t *testing.T) {
-	t.Run("it should unserialize and serialize a playlist", func(t *testing.T) {
-		data := `[{"path":"/foo","hash":"bar","preset":"dnb","bpm":100}]`
+func TestImportCSV(t *testing.T) {
+	store := &memory{tracks: []mkcdj.Track{
+		{Path: "/music/a.flac", Hash: "a", Preset: mkcdj.Presets[5], BPM: 124.6, Key: "8A"},
+		{Path: "/music/b.flac", Hash: "b", Preset: mkcdj.Presets[5], BPM: 120.2},
+	}}
 
-		var tracks []mkcdj.Track
-		noerr(t, json.Unmarshal([]byte(data), &tracks))
-		assert(t, "/foo", tracks[0].Path)
-		assert(t, "bar", tracks[0].Hash)
-		assert(t, "dnb", tracks[0].Preset.Name)
-		assert(t, 100, tracks[0].BPM)
+	SUT := mkcdj.New(mkcdj.WithStore(store))
 
-		got, err := json.Marshal(&tracks)
-		noerr(t, err)
-		assert(t, data, string(got))
-	})
+	in := strings.Join([]string{
+		"path,hash,preset,bpm,duration,quality",
+		"/music/a.flac,a,techno,125,,",
+		"/music/b.flac,b,house,122,,",
+		"/music/c.flac,c,unknown,100,,",
+		"/music/d.flac,d,hiphop,98,180,",
+	}, "\n")
 
-	t.Run("it should use the default preset if the track preset is empty", func(t *testing.T) {
-		data := `[{"path":"/foo","hash":"bar","preset":"","bpm":100}]`
+	err := SUT.ImportCSV(strings.NewReader(in))
+	assert(t, true, err != nil && strings.Contains(err.Error(), "line 4"))
 
-		var tracks []mkcdj.Track
-		noerr(t, json.Unmarshal([]byte(data), &tracks))
-		assert(t, "default", tracks[0].Preset.Name)
-	})
+	tracks := store.tracks
+	assert(t, 3, len(tracks))
+
+	assert(t, "hiphop", tracks[0].Preset.Name)
+	assert(t, 180, tracks[0].Duration)
+
+	assert(t, "house", tracks[1].Preset.Name)
+	assert(t, 122, tracks[1].BPM)
+
+	assert(t, "techno", tracks[2].Preset.Name)
+	assert(t, 124.6, tracks[2].BPM)
+	assert(t, "8A", tracks[2].Key)
+
+	assert(t, true, SUT.ImportCSV(strings.NewReader("path,bpm\n")) != nil)
 }
 
-func TestAnalyze(t *testing.T) {
+func TestVerify(t *testing.T) {
 	SUT, params := setup(t)
 
-	// Do the analysis twice to check duplication.
-	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.Verify(out))
+	assert(t, "", out.String())
+
+	noerr(t, os.WriteFile(params.SourceFilePath, []byte("changed\n"), 0666))
+	assert(t, true, SUT.Verify(out) != nil)
+	assert(t, "[stale] "+params.SourceFilePath+"\n", out.String())
+
+	out.Reset()
+	noerr(t, os.Remove(params.SourceFilePath))
+	assert(t, true, SUT.Verify(out) != nil)
+	assert(t, "[missing] "+params.SourceFilePath+"\n", out.String())
+
+	assert(t, 1, len(loadPlaylist(t, params.PlaylistFilePath)))
+}
+
+func TestReadOnly(t *testing.T) {
+	_, params := setup(t)
+
+	data, err := os.ReadFile(params.PlaylistFilePath)
+	noerr(t, err)
+
+	store := filepath.Join(t.TempDir(), "mkcdj.json")
+	noerr(t, os.WriteFile(store, data, 0666))
+
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	noerr(t, os.Chtimes(store, past, past))
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(store),
+		mkcdj.WithBackups(1),
+	)
+
+	for _, f := range [...]func(io.Writer) error{
+		SUT.Verify,
+		SUT.Names,
+		SUT.ExportCSV,
+		SUT.ListNDJSON,
+	} {
+		noerr(t, f(io.Discard))
+	}
+
+	info, err := os.Stat(store)
+	noerr(t, err)
+	assert(t, true, info.ModTime().Equal(past))
+
+	_, err = os.Stat(store + ".bak")
+	assert(t, true, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestFiles(t *testing.T) {
+	SUT, params := setup(t)
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.Files(out, '\n'))
+	assert(t, params.SourceFilePath+"\n", out.String())
+
+	out.Reset()
+	noerr(t, SUT.Files(out, 0))
+	assert(t, params.SourceFilePath+"\x00", out.String())
+}
+
+func TestNames(t *testing.T) {
+	SUT, params := setup(t)
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.Names(out))
+
+	name := filepath.Join("audio", "default", "100 - mkcdj-source.wav")
+	assert(t, params.SourceFilePath+" -> "+name+"\n", out.String())
+
+	SUT = mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+	)
+
+	dir, err := SUT.Compile(context.Background(), params.OutDirPath)
+	noerr(t, err)
+
+	checkFile(t, dir, name)
+}
+
+func TestBaseDir(t *testing.T) {
+	_, params := setup(t)
+	noerr(t, os.WriteFile(params.PlaylistFilePath, []byte("[]"), 0666))
+
+	root := filepath.Dir(params.SourceFilePath)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithBaseDir(root),
+	)
+
 	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+	assert(t, "mkcdj-source.flac", loadPlaylist(t, params.PlaylistFilePath)[0].Path)
+
+	// The library moves to another mount point.
+	moved := t.TempDir()
+	noerr(t, os.Rename(params.SourceFilePath, filepath.Join(moved, "mkcdj-source.flac")))
+
+	SUT = mkcdj.New(mkcdj.WithRepository(params.PlaylistFilePath), mkcdj.WithBaseDir(moved))
+
+	noerr(t, SUT.Verify(io.Discard))
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.Files(out, '\n'))
+	assert(t, filepath.Join(moved, "mkcdj-source.flac")+"\n", out.String())
+
+	noerr(t, SUT.Prune())
+	assert(t, "mkcdj-source.flac", loadPlaylist(t, params.PlaylistFilePath)[0].Path)
+
+	// Without a base directory, the relative path is not found.
+	err := mkcdj.New(mkcdj.WithRepository(params.PlaylistFilePath)).Verify(io.Discard)
+	assert(t, true, err != nil)
+}
+
+func TestRebase(t *testing.T) {
+	SUT, params := setup(t)
+
+	from, to := filepath.Dir(params.SourceFilePath), t.TempDir()
+
+	n, err := SUT.Rebase(from[:len(from)-1], to)
+	noerr(t, err)
+	assert(t, 0, n)
+
+	n, err = SUT.Rebase(from+"/", to)
+	noerr(t, err)
+	assert(t, 1, n)
 
 	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	assert(t, filepath.Join(to, "mkcdj-source.flac"), tracks[0].Path)
+	assert(t, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", tracks[0].Hash)
+
+	tracks = append(tracks, mkcdj.Track{Path: params.SourceFilePath, Hash: "other", BPM: 100, Preset: mkcdj.Presets[0]})
+	payload, err := json.Marshal(tracks)
+	noerr(t, err)
+	noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+	_, err = SUT.Rebase(from, to)
+	assert(t, true, err != nil)
+	assert(t, 2, len(loadPlaylist(t, params.PlaylistFilePath)))
+}
+
+func TestListStatus(t *testing.T) {
+	SUT, params := setup(t)
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.ListStatus(out, "good"))
+	assert(t, true, strings.HasPrefix(out.String(), "[good]"))
+
+	noerr(t, os.Remove(params.SourceFilePath))
 
+	out.Reset()
+	noerr(t, SUT.ListStatus(out, "good", "warn"))
+	assert(t, "", out.String())
+
+	out.Reset()
+	noerr(t, SUT.ListStatus(out, "fail"))
+	assert(t, true, strings.HasPrefix(out.String(), "[fail]"))
+
+	assert(t, true, SUT.ListStatus(out, "broken") != nil)
+}
+
+func TestSearch(t *testing.T) {
+	SUT, _ := setup(t)
+
+	tests := []struct {
+		filter mkcdj.Filter
+		want   int
+	}{
+		{mkcdj.Filter{}, 1},
+		{mkcdj.Filter{Preset: "default"}, 1},
+		{mkcdj.Filter{Preset: "dnb"}, 0},
+		{mkcdj.Filter{Min: 100, Max: 100}, 1},
+		{mkcdj.Filter{Min: 101}, 0},
+		{mkcdj.Filter{Max: 99}, 0},
+	}
+
+	for _, test := range tests {
+		out := bytes.NewBuffer(nil)
+		noerr(t, SUT.Search(out, test.filter))
+		assert(t, test.want, strings.Count(out.String(), "\n"))
+	}
+
+	_, want := mkcdj.PresetFromName("foo")
+	got := SUT.Search(io.Discard, mkcdj.Filter{Preset: "foo"})
+	assert(t, want.Error(), got.Error())
+}
+
+func TestExtract(t *testing.T) {
+	SUT, _ := setup(t)
+
+	var tracks []mkcdj.Track
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.Extract(out, mkcdj.Filter{Preset: "default"}))
+	noerr(t, json.Unmarshal(out.Bytes(), &tracks))
 	assert(t, 1, len(tracks))
-	assert(t, params.SourceFilePath, tracks[0].Path)
-	assert(t, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", tracks[0].Hash)
-	assert(t, 100, tracks[0].BPM)
+
+	out.Reset()
+	noerr(t, SUT.Extract(out, mkcdj.Filter{Preset: "dnb"}))
+	noerr(t, json.Unmarshal(out.Bytes(), &tracks))
+	assert(t, 0, len(tracks))
 }
 
-func TestRefresh(t *testing.T) {
+func TestRemove(t *testing.T) {
 	SUT, params := setup(t)
 
-	noerr(t, SUT.Refresh(context.Background()))
+	match := func(t mkcdj.Track) bool { return t.Preset.Name == "default" }
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.Remove(out, match, true))
+
+	assert(t, 1, strings.Count(out.String(), "\n"))
+	assert(t, 1, len(loadPlaylist(t, params.PlaylistFilePath)))
+
+	noerr(t, SUT.Remove(io.Discard, match, false))
+
+	assert(t, 0, len(loadPlaylist(t, params.PlaylistFilePath)))
+}
+
+func TestPruneBelowQuality(t *testing.T) {
+	SUT, params := setup(t)
+
+	// Unscored tracks are kept by default.
+	noerr(t, SUT.Remove(io.Discard, mkcdj.BelowQuality(quality.Threshold, false), false))
+	assert(t, 1, len(loadPlaylist(t, params.PlaylistFilePath)))
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.Remove(out, mkcdj.BelowQuality(quality.Threshold, true), true))
+	assert(t, 1, strings.Count(out.String(), "\n"))
+	assert(t, 1, len(loadPlaylist(t, params.PlaylistFilePath)))
+
+	noerr(t, SUT.Remove(io.Discard, mkcdj.BelowQuality(quality.Threshold, true), false))
+	assert(t, 0, len(loadPlaylist(t, params.PlaylistFilePath)))
+}
+
+func TestPruneZeroQuality(t *testing.T) {
+	SUT, params := setup(t)
+
+	good := filepath.Join(t.TempDir(), "good.flac")
+	noerr(t, os.WriteFile(good, []byte("good"), 0666))
 
 	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	tracks[0].Scored = true
+	tracks = append(tracks, mkcdj.Track{Path: good, Hash: "good", BPM: 100, Preset: mkcdj.Presets[0], Quality: 0.5, Scored: true})
+	payload, err := json.Marshal(tracks)
+	noerr(t, err)
+	noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+	// A stored score of 0 is the lowest score, not a missing one.
+	noerr(t, SUT.Remove(io.Discard, mkcdj.BelowQuality(quality.Threshold, false), false))
 
+	tracks = loadPlaylist(t, params.PlaylistFilePath)
 	assert(t, 1, len(tracks))
-	assert(t, params.SourceFilePath, tracks[0].Path)
-	assert(t, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", tracks[0].Hash)
-	assert(t, 100, tracks[0].BPM)
+	assert(t, good, tracks[0].Path)
+
+	// An explicit threshold of 0 matches nothing.
+	noerr(t, SUT.Remove(io.Discard, mkcdj.BelowQuality(0, true), false))
+	assert(t, 1, len(loadPlaylist(t, params.PlaylistFilePath)))
 }
 
-func TestCompile(t *testing.T) {
+func TestBundle(t *testing.T) {
 	SUT, params := setup(t)
 
-	noerr(t, SUT.Compile(context.Background(), params.OutDirPath))
+	archive := bytes.NewBuffer(nil)
+	noerr(t, SUT.Bundle(archive, true))
 
-	files := listFiles(t, params.OutDirPath)
+	dir := t.TempDir()
+	store := filepath.Join(dir, "mkcdj.json")
+	noerr(t, os.WriteFile(store, []byte("[]"), 0666))
 
-	t.Log(files)
+	noerr(t, mkcdj.New(mkcdj.WithRepository(store)).Unbundle(archive, dir))
 
-	base, ext := filepath.Base(params.SourceFilePath), filepath.Ext(params.SourceFilePath)
+	tracks := loadPlaylist(t, store)
 
-	want := fmt.Sprintf("100 - %s", base[:len(base)-len(ext)])
+	assert(t, 1, len(tracks))
+	assert(t, true, strings.HasPrefix(tracks[0].Path, dir))
+	assert(t, filepath.Base(params.SourceFilePath), filepath.Base(tracks[0].Path))
 
-	assert(t, 3, len(files))
-	assert(t, want+".wav", filepath.Base(files[0]))
-	assert(t, "default", filepath.Base(filepath.Dir(files[0])))
+	content, err := os.ReadFile(tracks[0].Path)
+	noerr(t, err)
+	assert(t, "hello\n", string(content))
+}
 
-	checkFile(t, params.OutDirPath, filepath.Dir(files[0]), want+".wav")
-	checkFile(t, params.OutDirPath, filepath.Dir(files[1]), want+".png")
-	checkFile(t, params.OutDirPath, filepath.Dir(files[2]), want+".png")
+func TestFormat(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+		mkcdj.WithFormat("mp3", writeOk),
+	)
+
+	assert(t, true, SUT.SetFormat(params.SourceFilePath, "ogg") != nil)
+	assert(t, true, SUT.SetFormat("unknown", "mp3") != nil)
+
+	noerr(t, SUT.SetFormat(params.SourceFilePath, "mp3"))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, "mp3", tracks[0].Format)
+
+	noerr(t, SUT.SetFormat(tracks[0].Hash, ""))
+
+	tracks = loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, "", tracks[0].Format)
+}
+
+func TestSetPreset(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(mkcdj.WithRepository(params.PlaylistFilePath))
+
+	house, err := mkcdj.PresetFromName("house")
+	noerr(t, err)
+
+	hiphop, err := mkcdj.PresetFromName("hiphop")
+	noerr(t, err)
+
+	assert(t, true, SUT.SetPreset(params.SourceFilePath, house) != nil)
+	assert(t, true, SUT.SetPreset("unknown", hiphop) != nil)
+	assert(t, true, SUT.ForcePreset(params.SourceFilePath, mkcdj.Auto) != nil)
+
+	noerr(t, SUT.SetPreset(params.SourceFilePath, hiphop))
+	assert(t, "hiphop", loadPlaylist(t, params.PlaylistFilePath)[0].Preset.Name)
+
+	noerr(t, SUT.ForcePreset(params.SourceFilePath, house))
+	assert(t, "house", loadPlaylist(t, params.PlaylistFilePath)[0].Preset.Name)
+	assert(t, 100, loadPlaylist(t, params.PlaylistFilePath)[0].BPM)
+}
+
+func TestConvertFormat(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithFormat("flac", writeOk),
+		mkcdj.WithConvertFormat("flac"),
+	)
+
+	dir := t.TempDir()
+	noerr(t, os.MkdirAll(filepath.Join(dir, "default"), 0755))
+	noerr(t, os.WriteFile(filepath.Join(dir, "default", "100 - mkcdj-source.flac"), nil, 0666))
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.ExportM3U(out, dir))
+
+	want := "#EXTM3U\n#EXTINF:-1,100 - mkcdj-source\ndefault/100 - mkcdj-source.flac\n"
+	assert(t, want, out.String())
+}
+
+func TestKey(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeFloats(1, 2, 3)),
+		mkcdj.WithBPMScanFunc(readAll),
+		mkcdj.WithKeyScanFunc(func(r io.Reader) (string, error) {
+			data, err := io.ReadAll(r)
+			return fmt.Sprintf("%dA", len(data)/4), err
+		}),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+	assert(t, "3A", loadPlaylist(t, params.PlaylistFilePath)[0].Key)
+
+	SUT = mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeFloats(1, 2, 3)),
+		mkcdj.WithBPMScanFunc(readAll),
+		mkcdj.WithKeyScanFunc(func(r io.Reader) (string, error) {
+			return "", errors.New("no key")
+		}),
+	)
+
+	// The rest of the analysis is kept.
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	assert(t, "", tracks[0].Key)
+	assert(t, 100.0, tracks[0].BPM)
+}
+
+func TestKeyEarlyBPM(t *testing.T) {
+	_, params := setup(t)
+
+	// The BPM scanner returns without reading: the key scanner still gets the
+	// whole signal.
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeFloats(1, 2, 3)),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithKeyScanFunc(func(r io.Reader) (string, error) {
+			data, err := io.ReadAll(r)
+			return fmt.Sprintf("%dA", len(data)/4), err
+		}),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+	assert(t, "3A", loadPlaylist(t, params.PlaylistFilePath)[0].Key)
+}
+
+func TestTags(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithTagsProbeFunc(func(ctx context.Context, path string) (mkcdj.Tags, error) {
+			return mkcdj.Tags{Artist: "Artist", Title: "Title"}, nil
+		}),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	assert(t, "Artist", tracks[0].Artist)
+	assert(t, "Title", tracks[0].Title)
+
+	dir := t.TempDir()
+	noerr(t, os.MkdirAll(filepath.Join(dir, "default"), 0755))
+	noerr(t, os.WriteFile(filepath.Join(dir, "default", "100 - Artist - Title.wav"), nil, 0666))
+
+	out := bytes.NewBuffer(nil)
+	noerr(t, SUT.ExportM3U(out, dir))
+	assert(t, true, strings.HasSuffix(out.String(), "default/100 - Artist - Title.wav\n"))
+}
+
+func TestUnsafeNames(t *testing.T) {
+	_, params := setup(t)
+
+	newline := filepath.Join(t.TempDir(), "new\nline.flac")
+	noerr(t, os.WriteFile(newline, []byte("newline"), 0666))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+	tracks[0].Artist, tracks[0].Title = "AC/DC", "../../Back\tIn Black"
+	tracks = append(tracks, mkcdj.Track{Path: newline, Hash: "newline", BPM: 110, Preset: mkcdj.Presets[0]})
+	payload, err := json.Marshal(tracks)
+	noerr(t, err)
+	noerr(t, os.WriteFile(params.PlaylistFilePath, payload, 0666))
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Convert, writeOk),
+		mkcdj.WithPipeline(mkcdj.Waveform, writeOk),
+		mkcdj.WithPipeline(mkcdj.Spectrum, writeOk),
+	)
+
+	dir, err := SUT.Compile(context.Background(), params.OutDirPath)
+	noerr(t, err)
+
+	checkFile(t, dir, "audio", "default", "100 - AC-DC - ..-..-Back-In Black.wav")
+	checkFile(t, dir, "audio", "default", "110 - new-line.wav")
+
+	noerr(t, filepath.WalkDir(params.OutDirPath, func(path string, d fs.DirEntry, err error) error {
+		ext := filepath.Ext(path)
+		if rel, _ := filepath.Rel(dir, path); (ext == ".wav" || ext == ".png") && !filepath.IsLocal(rel) {
+			t.Errorf("outside of the output directory: %q", path)
+		}
+		return err
+	}))
+}
+
+func TestMislabeled(t *testing.T) {
+	_, params := setup(t)
+
+	SUT := mkcdj.New(
+		mkcdj.WithRepository(params.PlaylistFilePath),
+		mkcdj.WithPipeline(mkcdj.Analyze, writeOk),
+		mkcdj.WithBPMScanFunc(stubBPMScanner),
+		mkcdj.WithCodecProbeFunc(func(ctx context.Context, path string) (string, error) {
+			return "mp3", nil
+		}),
+	)
+
+	noerr(t, SUT.Analyze(context.Background(), params.SourceFilePath, mkcdj.Presets[0]))
+
+	tracks := loadPlaylist(t, params.PlaylistFilePath)
+
+	assert(t, "mp3", tracks[0].Codec)
+	assert(t, true, strings.HasPrefix(tracks[0].String(), "[warn]"))
 }
 
 type params struct {
@@ -188,7 +2406,7 @@ func assert[T comparable](t *testing.T, want, got T) {
 	}
 }
 
-func noerr(t *testing.T, err error) {
+func noerr(t testing.TB, err error) {
 	t.Helper()
 	if err != nil {
 		t.Fatal(err)
@@ -202,6 +2420,28 @@ func stubCmd(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) err
 	return err
 }
 
+var block = mkcdj.PipelineFunc(func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+	<-ctx.Done()
+	return ctx.Err()
+})
+
+func writeFloats(values ...float32) mkcdj.Pipeline {
+	return mkcdj.PipelineFunc(func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+		return binary.Write(stdout, binary.LittleEndian, values)
+	})
+}
+
+func readFloat(r io.Reader, min, max float64) (float64, error) {
+	var f float32
+	err := binary.Read(r, binary.LittleEndian, &f)
+	return float64(f), err
+}
+
+func readAll(r io.Reader, min, max float64) (float64, error) {
+	_, err := io.Copy(io.Discard, r)
+	return 100, err
+}
+
 func stubBPMScanner(r io.Reader, min, max float64) (float64, error) {
 	return 100, nil
 }
@@ -0,0 +1,109 @@
+// Package quality estimates the fidelity of an audio file from its spectrum.
+// Lossy encoders cut high frequencies, so a file transcoded from a lossy
+// source has little energy above the cutoff compared to the band below it.
+package quality
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Default bands, tuned for 44.1kHz sources.
+	LowCut  = 16000
+	HighCut = 20000
+
+	// Threshold is the score under which a file is considered low quality.
+	Threshold = 0.1
+)
+
+// Formats are the file extensions sox(1) decodes without optional libraries.
+var Formats = []string{".wav", ".flac", ".aif", ".aiff", ".ogg"}
+
+// ErrUnsupported is returned by Scan for files not in one of the Formats.
+var ErrUnsupported = errors.New("unsupported format")
+
+// Scan returns the quality score of an audio file using sox(1).
+func Scan(ctx context.Context, path string) (float64, error) {
+	if ext := strings.ToLower(filepath.Ext(path)); !slices.Contains(Formats, ext) {
+		return 0, fmt.Errorf("%w: %q", ErrUnsupported, ext)
+	}
+
+	stderr := bytes.NewBuffer(nil)
+
+	cmd := exec.CommandContext(ctx, "sox", path, "-n", "stat", "-freq")
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return 0, err
+	}
+
+	return Parse(stderr)
+}
+
+// Parse returns the quality score from the output of `sox stat -freq`, made of
+// frequency and magnitude pairs. The score is the ratio between the mean
+// magnitude above 20kHz and the mean magnitude between 16kHz and 20kHz.
+// Lines that are not frequency/magnitude pairs are ignored. An error is
+// returned if either band is empty rather than a meaningless score.
+func Parse(r io.Reader) (float64, error) {
+	return ParseWithBands(r, LowCut, HighCut)
+}
+
+// ParseWithBands is like Parse with custom cutoffs, in Hz: the score compares
+// the band above highCut to the band between lowCut and highCut.
+func ParseWithBands(r io.Reader, lowCut, highCut int) (float64, error) {
+	if lowCut < 0 || lowCut >= highCut {
+		return 0, fmt.Errorf("invalid bands: %dHz to %dHz", lowCut, highCut)
+	}
+
+	var lt, ht, lc, hc float64
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		freq, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+
+		mag, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || math.IsNaN(mag) || math.IsInf(mag, 0) {
+			continue
+		}
+
+		switch {
+		case freq >= float64(highCut):
+			ht, hc = ht+mag, hc+1
+		case freq >= float64(lowCut):
+			lt, lc = lt+mag, lc+1
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case hc == 0:
+		return 0, fmt.Errorf("no spectral data above %dHz", highCut)
+	case lc == 0 || lt == 0:
+		return 0, fmt.Errorf("no spectral data between %dHz and %dHz", lowCut, highCut)
+	}
+
+	return (ht / hc) / (lt / lc), nil
+}
@@ -0,0 +1,101 @@
+package quality_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mkcdj/quality"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	data := strings.Join([]string{
+		"15000.000000  9.000000",
+		"16000.000000  3.000000",
+		"18000.000000  3.000000",
+		"20000.000000  1.000000",
+		"22000.000000  1.000000",
+		"Samples read:  441000",
+	}, "\n")
+
+	got, err := quality.Parse(strings.NewReader(data))
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert(t, "0.3333", fmt.Sprintf("%.4f", got))
+}
+
+func TestParseEmpty(t *testing.T) {
+	if _, err := quality.Parse(strings.NewReader("")); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	data := strings.Join([]string{
+		"",
+		"Frequency  Magnitude",
+		"   ",
+		"16000.000000",
+		"16000.000000  3.000000  extra",
+		"Samples read:  441000",
+		"Length (seconds):  10.000000",
+	}, "\n")
+
+	if _, err := quality.Parse(strings.NewReader(data)); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
+
+func TestParseNoHighFrequency(t *testing.T) {
+	data := strings.Join([]string{
+		"15000.000000  9.000000",
+		"16000.000000  3.000000",
+		"18000.000000  3.000000",
+		"19000.000000  NaN",
+	}, "\n")
+
+	_, err := quality.Parse(strings.NewReader(data))
+	if err == nil {
+		t.Fatal("want: error, got: nil")
+	}
+
+	assert(t, "no spectral data above 20000Hz", err.Error())
+}
+
+func TestParseWithBands(t *testing.T) {
+	data := strings.Join([]string{
+		"16000.000000  9.000000",
+		"18000.000000  3.000000",
+		"20000.000000  3.000000",
+		"22000.000000  1.000000",
+		"23000.000000  1.000000",
+	}, "\n")
+
+	got, err := quality.ParseWithBands(strings.NewReader(data), 18000, 22000)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert(t, "0.3333", fmt.Sprintf("%.4f", got))
+
+	if _, err := quality.ParseWithBands(strings.NewReader(data), 20000, 20000); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
+
+func TestScanUnsupported(t *testing.T) {
+	for _, path := range [...]string{"track.m4a", "track.MP3", "track"} {
+		if _, err := quality.Scan(context.Background(), path); !errors.Is(err, quality.ErrUnsupported) {
+			t.Errorf("%s: want: %v, got: %v", path, quality.ErrUnsupported, err)
+		}
+	}
+}
+
+func assert(t *testing.T, want, got string) {
+	if want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+}
@@ -0,0 +1,106 @@
+// Package selftest checks the whole analysis chain against bundled reference
+// files with known properties.
+package selftest
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mkcdj/bpm"
+	"mkcdj/ffmpeg"
+	"strings"
+	"time"
+)
+
+var (
+	//go:embed testdata/track.dat
+	dat []byte
+
+	//go:embed testdata/track.wav
+	wav []byte
+)
+
+const (
+	// Reference BPM of the bundled f32le data and detection tolerance.
+	Want      = 118
+	Tolerance = 3
+)
+
+var pipelines = [...]struct {
+	name string
+	run  func(context.Context, io.Reader, io.Writer, io.Writer) error
+}{
+	{"analyze", ffmpeg.F32LE},
+	{"convert", ffmpeg.AudioOut},
+	{"waveform", ffmpeg.PNGWaveform},
+	{"spectrum", ffmpeg.PNGSpectrum},
+}
+
+// Run executes every check and reports the outcome of each one to out.
+// It returns an error if at least one check failed.
+func Run(ctx context.Context, out io.Writer) error {
+	var failed int
+
+	report := func(name string, err error) error {
+		if err != nil {
+			failed++
+			_, err = fmt.Fprintf(out, "[fail] %s: %v\n", name, err)
+		} else {
+			_, err = fmt.Fprintf(out, "[ok] %s\n", name)
+		}
+		return err
+	}
+
+	if err := report("bpm", scan()); err != nil {
+		return err
+	}
+
+	for _, p := range pipelines {
+		if err := report(p.name, pipeline(ctx, p.run)); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(pipelines)+1)
+	}
+
+	return nil
+}
+
+func scan() error {
+	got, err := bpm.Scan(bytes.NewReader(dat), 115, 128)
+	if err != nil {
+		return err
+	}
+
+	if math.Abs(got-Want) > Tolerance {
+		return fmt.Errorf("want: %d±%d, got: %.2f", Want, Tolerance, got)
+	}
+
+	return nil
+}
+
+func pipeline(parent context.Context, run func(context.Context, io.Reader, io.Writer, io.Writer) error) error {
+	ctx, cancel := context.WithTimeout(parent, 10*time.Second)
+	defer cancel()
+
+	stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+
+	if err := run(ctx, bytes.NewReader(wav), stdout, stderr); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%w: %s", err, message)
+		}
+		return err
+	}
+
+	if stdout.Len() == 0 {
+		return errors.New("empty output")
+	}
+
+	return nil
+}
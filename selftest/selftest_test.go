@@ -0,0 +1,9 @@
+package selftest
+
+import "testing"
+
+func TestScan(t *testing.T) {
+	if err := scan(); err != nil {
+		t.Error(err)
+	}
+}